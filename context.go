@@ -14,10 +14,17 @@ type ctxOptions struct {
 	key          Key            // entry key.
 	ref          bool           // indicates if the key is a reference key.
 	ttl          time.Duration  // entry duration.
+	softTTL      time.Duration  // entry duration before it is refreshed in background.
 	skipMode     cache.SkipMode // skip mode
+	typ          string         // entity type of a hash query, its result is indexed by the ids.
+	tags         []string       // tags of the cache entry.
+	limit        int            // max rows read by the query, see limitQuery.
 }
 
-var ctxOptionsKey ctxOptions
+// optionsCtxKey is the context key of ctxOptions, the options are not comparable to be a key.
+type optionsCtxKey struct{}
+
+var ctxOptionsKey optionsCtxKey
 
 // Skip returns a new Context that tells the Driver
 // to skip the cache entry on Query.
@@ -94,3 +101,64 @@ func WithTTL(ctx context.Context, ttl time.Duration) context.Context {
 	c.ttl = ttl
 	return ctx
 }
+
+// WithSoftTTL returns a new Context that carries the soft TTL for the cache entry, see Config.SoftTTL. The hard
+// TTL is set by WithTTL.
+//
+//	client.T.Query().All(entcache.WithSoftTTL(entcache.WithTTL(ctx, time.Minute), 5*time.Second))
+func WithSoftTTL(ctx context.Context, ttl time.Duration) context.Context {
+	c, ok := ctx.Value(ctxOptionsKey).(*ctxOptions)
+	if !ok {
+		return context.WithValue(ctx, ctxOptionsKey, &ctxOptions{softTTL: ttl})
+	}
+	c.softTTL = ttl
+	return ctx
+}
+
+// WithTags returns a new Context that carries the tags for the cache entries, the entries can be removed
+// by the tags with Driver.InvalidateTags. The tags apply to all queries with the context, include eager loading.
+//
+//	client.T.Query().All(entcache.WithTags(ctx, "tenant:42", "dashboard"))
+func WithTags(ctx context.Context, tags ...string) context.Context {
+	c, ok := ctx.Value(ctxOptionsKey).(*ctxOptions)
+	if !ok {
+		return context.WithValue(ctx, ctxOptionsKey, &ctxOptions{tags: append([]string(nil), tags...)})
+	}
+	c.tags = append(c.tags, tags...)
+	return ctx
+}
+
+// skipCacheContext returns a new Context that tells the Driver to read the database. Unlike Skip, the options
+// carried by ctx are overridden rather than changed.
+func skipCacheContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxOptionsKey, &ctxOptions{skipMode: cache.SkipCache})
+}
+
+// limitContext returns a new Context that tells the Driver to read the database and at most n rows, such as
+// resolving the ids of a bulk mutation up to the type threshold.
+func limitContext(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, ctxOptionsKey, &ctxOptions{skipMode: cache.SkipCache, limit: n})
+}
+
+// mutationScope is carried by the context of a mutation running through DataChangeNotify.
+type mutationScope struct {
+	// table is the table of the mutated entity, the statements on it are recorded by the hook.
+	table string
+	// tx is the transaction which the statements of the mutation are executed in.
+	tx *Tx
+	// upsert reports whether an upsert statement is executed on the table.
+	upsert bool
+}
+
+type mutationCtxKey struct{}
+
+// newMutationContext returns a new Context that carries the mutation scope.
+func newMutationContext(ctx context.Context, table string) context.Context {
+	return context.WithValue(ctx, mutationCtxKey{}, &mutationScope{table: table})
+}
+
+// mutationFromContext returns the mutation scope carried by the context, or nil.
+func mutationFromContext(ctx context.Context) *mutationScope {
+	s, _ := ctx.Value(mutationCtxKey{}).(*mutationScope)
+	return s
+}
@@ -0,0 +1,210 @@
+package entcache
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// idColumn is the primary key column, which ent always selects.
+	idColumn = "id"
+	// defaultDepIndexSize is the default max number of the rows indexed.
+	defaultDepIndexSize = 1 << 20
+)
+
+// depIndex is the reverse index from the entities to the hash entries whose results contain them, so that an
+// entry listing a changed entity is evicted at once rather than by its TTL.
+//
+// The changes recorded by the Driver carry the table keys, which evict the hash entries on their next query as
+// well. The index covers the changes without them, such as the entity keys fed by a ChangeSource, and deletes the
+// entries at once rather than on the next query.
+//
+// The index is kept in process memory. With a shared cache, the entries cached by other instances are
+// evicted by them once they receive the change through a Transport. The expired entries are removed by the gc
+// loop of the MemoryChangeSet, or on add with other ChangeSets.
+//
+// The index is bounded by the number of the rows indexed, the oldest results are dropped to make room, since
+// their entries may be evicted from the cache already. A dropped result is still evicted by its table key.
+type depIndex struct {
+	mu sync.Mutex
+	// entities maps the entity key to the hash entry keys.
+	entities map[Key]map[Key]struct{}
+	// results maps the hash entry key to what its result depends on.
+	results map[Key]depResult
+	// gcInterval is the interval to remove the expired entries, and the lifetime of the entries without ttl.
+	gcInterval time.Duration
+	lastGC     time.Time
+	// maxSize is the max number of the rows indexed, size is the current one.
+	maxSize, size int
+	// order holds the results in the order added, the ones replaced or removed are skipped by the seq.
+	order []depOrder
+	seq   uint64
+}
+
+// depOrder is a result in the order added.
+type depOrder struct {
+	key Key
+	seq uint64
+}
+
+// depResult is the dependency of a hash entry.
+type depResult struct {
+	entities []Key
+	// columns are the columns of the result, only the change of them evicts the entry.
+	columns map[string]struct{}
+	expire  time.Time
+	seq     uint64
+}
+
+func newDepIndex(gcInterval time.Duration, maxSize int) *depIndex {
+	if gcInterval <= 0 {
+		gcInterval = defaultGCInterval
+	}
+	if maxSize <= 0 {
+		maxSize = defaultDepIndexSize
+	}
+	return &depIndex{
+		entities:   make(map[Key]map[Key]struct{}),
+		results:    make(map[Key]depResult),
+		gcInterval: gcInterval,
+		lastGC:     time.Now(),
+		maxSize:    maxSize,
+	}
+}
+
+// add indexes the rows of the hash entry by their ids, it replaces the previous result of the entry. The
+// result without the id column is not indexed.
+func (x *depIndex) add(key Key, typ string, columns []string, values [][]driver.Value, ttl time.Duration) {
+	idx := -1
+	for i, c := range columns {
+		if strings.EqualFold(c, idColumn) {
+			idx = i
+			break
+		}
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.remove(key)
+	if time.Since(x.lastGC) > x.gcInterval {
+		x.gc()
+	}
+	if idx < 0 || len(values) == 0 || len(values) > x.maxSize {
+		return
+	}
+	x.shrink(x.maxSize - len(values))
+	if ttl <= 0 {
+		ttl = x.gcInterval
+	}
+	x.seq++
+	res := depResult{
+		entities: make([]Key, 0, len(values)),
+		columns:  make(map[string]struct{}, len(columns)),
+		expire:   time.Now().Add(ttl),
+		seq:      x.seq,
+	}
+	for _, c := range columns {
+		res.columns[c] = struct{}{}
+	}
+	for _, row := range values {
+		v := row[idx]
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		ek := NewEntryKey(typ, fmt.Sprint(v))
+		keys, ok := x.entities[ek]
+		if !ok {
+			keys = make(map[Key]struct{})
+			x.entities[ek] = keys
+		}
+		keys[key] = struct{}{}
+		res.entities = append(res.entities, ek)
+	}
+	x.results[key] = res
+	x.size += len(res.entities)
+	x.order = append(x.order, depOrder{key: key, seq: res.seq})
+}
+
+// shrink drops the oldest results until at most size rows are indexed, the caller must hold the lock.
+func (x *depIndex) shrink(size int) {
+	for x.size > size && len(x.order) > 0 {
+		o := x.order[0]
+		x.order = x.order[1:]
+		if res, ok := x.results[o.key]; ok && res.seq == o.seq {
+			x.remove(o.key)
+		}
+	}
+	// the order holds the results removed otherwise as well, it is compacted when they are the majority.
+	if len(x.order) > 2*len(x.results)+16 {
+		order := make([]depOrder, 0, len(x.results))
+		for _, o := range x.order {
+			if res, ok := x.results[o.key]; ok && res.seq == o.seq {
+				order = append(order, o)
+			}
+		}
+		x.order = order
+	}
+}
+
+// evict returns the hash entries depending on the changed keys and removes them from the index. An entry key
+// evicts all entries containing the entity, a field key only evicts the entries reading the field.
+func (x *depIndex) evict(changes ...Key) []Key {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var evicted []Key
+	for _, change := range changes {
+		ek, field, isField := strings.Cut(string(change), "#")
+		if isField && field == "" {
+			// the marker of any changed field, the changed fields are stored with it.
+			continue
+		}
+		for key := range x.entities[Key(ek)] {
+			if isField {
+				if _, ok := x.results[key].columns[field]; !ok {
+					continue
+				}
+			}
+			x.remove(key)
+			evicted = append(evicted, key)
+		}
+	}
+	return evicted
+}
+
+// remove removes the hash entry from the index, the caller must hold the lock.
+func (x *depIndex) remove(key Key) {
+	res, ok := x.results[key]
+	if !ok {
+		return
+	}
+	delete(x.results, key)
+	x.size -= len(res.entities)
+	for _, ek := range res.entities {
+		if keys, ok := x.entities[ek]; ok {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(x.entities, ek)
+			}
+		}
+	}
+}
+
+// collect removes the expired entries, it is run by the gc loop of the ChangeSet.
+func (x *depIndex) collect() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.gc()
+}
+
+// gc removes the expired entries, the caller must hold the lock.
+func (x *depIndex) gc() {
+	now := time.Now()
+	for key, res := range x.results {
+		if now.After(res.expire) {
+			x.remove(key)
+		}
+	}
+	x.lastGC = now
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	stdsql "database/sql"
 	"database/sql/driver"
+	"entgo.io/ent"
 	"entgo.io/ent/dialect"
 	"entgo.io/ent/dialect/sql"
 	"errors"
@@ -13,6 +14,7 @@ import (
 	"github.com/tsingsun/woocoo/pkg/conf"
 	"github.com/tsingsun/woocoo/pkg/log"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	_ "unsafe"
@@ -22,8 +24,9 @@ import (
 func convertAssign(dest, src any) error
 
 const (
-	defaultDriverName = "default"
-	defaultGCInterval = time.Hour
+	defaultDriverName   = "default"
+	defaultGCInterval   = time.Hour
+	defaultTxEvictDelay = time.Second
 )
 
 var (
@@ -41,6 +44,17 @@ type (
 		*Config
 		dialect.Driver
 		stats Stats
+		deps  *depIndex
+		tags  tagStore
+		gens  generations
+		// flights are the in-flight queries, see Config.SingleFlight.
+		flights flightGroup
+		// fillLock is nil if it is disabled, see Config.FillLockTTL.
+		fillLock *fillLock
+		leases   leases
+		// refreshing holds the keys being refreshed in background, refreshSem bounds the concurrency.
+		refreshing sync.Map
+		refreshSem chan struct{}
 
 		Hash func(query string, args []any) (Key, error)
 	}
@@ -49,15 +63,24 @@ type (
 		Gets   uint64
 		Hits   uint64
 		Errors uint64
+		// Coalesced is the number of the cache misses served by the in-flight identical queries.
+		Coalesced uint64
+		// FillLockHits is the number of the cache misses served by the fill of another instance.
+		FillLockHits uint64
+		// LeaseRevoked is the number of the entries not stored, since they were invalidated during the query.
+		LeaseRevoked uint64
+		// StaleHits is the number of the hits served by the stale entries, see Config.SoftTTL.
+		StaleHits uint64
 	}
 )
 
 // NewDriver wraps the given driver with a caching layer.
 func NewDriver(drv dialect.Driver, opts ...Option) *Driver {
 	options := &Config{
-		Name:        defaultDriverName,
-		GCInterval:  defaultGCInterval,
-		KeyQueryTTL: defaultGCInterval,
+		Name:         defaultDriverName,
+		GCInterval:   defaultGCInterval,
+		KeyQueryTTL:  defaultGCInterval,
+		TxEvictDelay: defaultTxEvictDelay,
 	}
 	for _, opt := range opts {
 		opt(options)
@@ -95,24 +118,71 @@ func NewDriver(drv dialect.Driver, opts ...Option) *Driver {
 	if d.ChangeSet == nil {
 		d.ChangeSet = NewChangeSet(d.GCInterval)
 	}
+	d.deps = newDepIndex(d.GCInterval, defaultDepIndexSize)
+	d.tags = newTagStore(d.Cache, d.CachePrefix, d.GCInterval)
+	d.gens = newGenerations(d.Cache, d.CachePrefix)
+	d.fillLock = newFillLock(d.Cache, d.CachePrefix, d.FillLockTTL, d.FillLockWait)
+	if d.RefreshConcurrency <= 0 {
+		d.RefreshConcurrency = defaultRefreshConcurrency
+	}
+	d.refreshSem = make(chan struct{}, d.RefreshConcurrency)
+	if r, ok := d.ChangeSet.(interface {
+		onReceive(func(keys []Key, remote bool))
+	}); ok {
+		r.onReceive(d.receiveChanges)
+	}
+	if g, ok := d.ChangeSet.(interface{ onGC(func()) }); ok {
+		g.onGC(d.deps.collect)
+	}
+	d.retain(d.KeyQueryTTL)
+	d.retain(d.HashQueryTTL)
 	return d
 }
 
+// retain reports the ttl of the cached entries to the ChangeSet, so that it keeps the changes as long as an entry
+// cached before them may live.
+func (d *Driver) retain(ttl time.Duration) {
+	if r, ok := d.ChangeSet.(interface{ retain(time.Duration) }); ok && ttl > 0 {
+		r.retain(ttl)
+	}
+}
+
+// Start runs the background work of the driver, such as the ChangeSet gc and the Transport subscription.
+// It blocks until the context is done.
+func (d *Driver) Start(ctx context.Context) error {
+	return d.ChangeSet.Start(ctx)
+}
+
+// Stop stops the background work of the driver.
+func (d *Driver) Stop(ctx context.Context) error {
+	return d.ChangeSet.Stop(ctx)
+}
+
 // Query implements the Querier interface for the driver. It falls back to the
 // underlying wrapped driver in case of caching error.
 //
 // Note that the driver does not synchronize identical queries that are executed
-// concurrently. Hence, if 2 identical queries are executed at the ~same time, and
+// concurrently by default. Hence, if 2 identical queries are executed at the ~same time, and
 // there is no cache entry for them, the driver will execute both of them and the
-// last successful one will be stored in the cache.
+// last successful one will be stored in the cache. Enable Config.SingleFlight to coalesce them.
 func (d *Driver) Query(ctx context.Context, query string, args, v any) error {
 	// Check if the given statement looks like a standard Ent query (e.g. SELECT).
 	// Custom queries (e.g. CTE) or statements that are prefixed with comments are
 	// not supported. This check is mainly necessary, because PostgreSQL and SQLite
 	// may execute an insert statement like "INSERT ... RETURNING" using Driver.Query.
-	if !strings.HasPrefix(query, "SELECT") && !strings.HasPrefix(query, "select") {
-		return d.Driver.Query(ctx, query, args, v)
+	if !isSelect(query) {
+		if err := d.Driver.Query(ctx, query, args, v); err != nil {
+			return err
+		}
+		d.storeWrite(ctx, query, args)
+		return nil
 	}
+	return d.query(ctx, d.Driver, nil, query, args, v)
+}
+
+// query runs a SELECT statement through the cache layer, the statement is executed by querier if the entry
+// is missing. tx is the read-write transaction overlaying the cache, or nil.
+func (d *Driver) query(ctx context.Context, querier dialect.ExecQuerier, tx *Tx, query string, args, v any) error {
 	vr, ok := v.(*sql.Rows)
 	if !ok {
 		return fmt.Errorf("entcache: invalid type %T. expect *sql.Rows", v)
@@ -121,9 +191,12 @@ func (d *Driver) Query(ctx context.Context, query string, args, v any) error {
 	if !ok {
 		return fmt.Errorf("entcache: invalid type %T. expect []interface{} for args", args)
 	}
-	opts, err := d.optionsFromContext(ctx, query, argv)
+	if c, ok := ctx.Value(ctxOptionsKey).(*ctxOptions); ok && c.limit > 0 {
+		query = limitQuery(query, c.limit)
+	}
+	opts, err := d.optionsFromContext(ctx, tx, query, argv)
 	if err != nil {
-		return d.Driver.Query(ctx, query, args, v)
+		return querier.Query(ctx, query, args, v)
 	}
 	atomic.AddUint64(&d.stats.Gets, 1)
 	var e Entry
@@ -136,34 +209,291 @@ func (d *Driver) Query(ctx context.Context, query string, args, v any) error {
 	case err == nil:
 		atomic.AddUint64(&d.stats.Hits, 1)
 		vr.ColumnScanner = &repeater{columns: e.Columns, values: e.Values}
+		if tx == nil && e.stale() {
+			atomic.AddUint64(&d.stats.StaleHits, 1)
+			d.refresh(ctx, query, args, opts)
+		}
 	case errors.Is(err, cache.ErrCacheMiss):
-		if err := d.Driver.Query(ctx, query, args, vr); err != nil {
-			return err
+		var f *flight
+		if d.SingleFlight && tx == nil && !opts.evict {
+			var e *Entry
+			if f, e, err = d.joinFlight(ctx, opts.key); err != nil {
+				return err
+			}
+			if e != nil {
+				atomic.AddUint64(&d.stats.Coalesced, 1)
+				vr.ColumnScanner = &repeater{columns: e.Columns, values: e.Values}
+				return nil
+			}
 		}
-		vr.ColumnScanner = &recorder{
-			ColumnScanner: vr.ColumnScanner,
-			onClose: func(columns []string, values [][]driver.Value) {
-				if opts.skipNotFound && len(values) == 0 {
-					return
+		var token string
+		if d.fillLock != nil && tx == nil && !opts.evict {
+			var e *Entry
+			if e, token, err = d.lockFill(ctx, opts); err != nil || e != nil {
+				if f != nil {
+					d.flights.leave(opts.key, f, e)
 				}
-				err := d.Cache.Set(ctx, string(opts.key), &Entry{Columns: columns, Values: values},
-					cache.WithTTL(opts.ttl), cache.WithSkip(opts.skipMode),
-				)
 				if err != nil {
-					atomic.AddUint64(&d.stats.Errors, 1)
-					logger.Warn(fmt.Sprintf("entcache: failed storing entry %v in cache: %v", opts.key, err))
+					return err
 				}
+				atomic.AddUint64(&d.stats.FillLockHits, 1)
+				vr.ColumnScanner = &repeater{columns: e.Columns, values: e.Values}
+				return nil
+			}
+		}
+		// the lease is taken before the query, the invalidations after it revoke the lease.
+		ls := d.leases.acquire(queryLeases(query, opts.tags))
+		if err := querier.Query(ctx, query, args, vr); err != nil {
+			if f != nil {
+				d.flights.leave(opts.key, f, nil)
+			}
+			if token != "" {
+				d.releaseFill(opts.key, token)
+			}
+			return err
+		}
+		if tx != nil {
+			// the rows read in a transaction may be uncommitted or from an older snapshot, they are not stored.
+			return nil
+		}
+		rec := &recorder{
+			ColumnScanner: vr.ColumnScanner,
+			onClose: func(columns []string, values [][]driver.Value) {
+				d.storeEntry(ctx, opts, ls, columns, values)
 			},
 		}
+		if token != "" {
+			key := opts.key
+			rec.onDone = func() {
+				d.releaseFill(key, token)
+			}
+		}
+		vr.ColumnScanner = rec
+		if f != nil {
+			key := opts.key
+			leave := func(e *Entry) {
+				d.flights.leave(key, f, e)
+			}
+			vr.ColumnScanner = &flightScanner{
+				recorder: rec,
+				ctx:      ctx,
+				fresh: func() bool {
+					return d.leases.valid(ls)
+				},
+				leave: leave,
+				stop:  context.AfterFunc(ctx, func() { leave(nil) }),
+			}
+		}
 	default:
-		return d.Driver.Query(ctx, query, args, v)
+		return querier.Query(ctx, query, args, v)
+	}
+	return nil
+}
+
+// storeEntry stores the rows recorded by the query of the lease into the cache.
+func (d *Driver) storeEntry(ctx context.Context, opts ctxOptions, ls lease, columns []string, values [][]driver.Value) {
+	if opts.skipNotFound && len(values) == 0 {
+		return
+	}
+	// the rows of a canceled query may be partial.
+	if ctx.Err() != nil {
+		return
+	}
+	if !d.leases.valid(ls) {
+		atomic.AddUint64(&d.stats.LeaseRevoked, 1)
+		return
+	}
+	d.retain(opts.ttl)
+	entry := &Entry{Columns: columns, Values: values}
+	if opts.softTTL > 0 && (opts.ttl <= 0 || opts.softTTL < opts.ttl) {
+		entry.StaleAt = time.Now().Add(opts.softTTL).UnixNano()
+	}
+	err := d.Cache.Set(ctx, string(opts.key), entry,
+		cache.WithTTL(opts.ttl), cache.WithSkip(opts.skipMode),
+	)
+	if err != nil {
+		atomic.AddUint64(&d.stats.Errors, 1)
+		logger.Warn(fmt.Sprintf("entcache: failed storing entry %v in cache: %v", opts.key, err))
+		return
+	}
+	if opts.typ != "" {
+		d.deps.add(opts.key, opts.typ, columns, values, opts.ttl)
 	}
+	if len(opts.tags) > 0 {
+		if err := d.tags.add(ctx, opts.key, opts.tags, opts.ttl); err != nil {
+			logger.Warn(fmt.Sprintf("entcache: failed tagging entry %v: %v", opts.key, err))
+		}
+	}
+}
+
+// joinFlight joins the in-flight query of the key. The leader gets the flight and runs the query, a follower
+// waits and gets the entry of the leader. If the leader failed or its context is done, the followers join again,
+// one of them becomes the next leader.
+func (d *Driver) joinFlight(ctx context.Context, key Key) (*flight, *Entry, error) {
+	for {
+		f, leader := d.flights.join(key)
+		if leader {
+			return f, nil, nil
+		}
+		e, err := f.wait(ctx)
+		if err != nil || e != nil {
+			return nil, e, err
+		}
+	}
+}
+
+// Exec implements the Execer interface for the driver. The data modification statements are recorded to
+// the ChangeSet, so the writes bypassing the ent hooks, such as raw sql and migrations, are also reflected.
+func (d *Driver) Exec(ctx context.Context, query string, args, v any) error {
+	if err := d.Driver.Exec(ctx, query, args, v); err != nil {
+		return err
+	}
+	d.storeWrite(ctx, query, args)
 	return nil
 }
 
+// storeWrite records the changes of a data modification statement executed out of a transaction.
+func (d *Driver) storeWrite(ctx context.Context, query string, args any) {
+	keys, event := d.writeChanges(ctx, query, args)
+	d.storeChanges(keys...)
+	if event != nil {
+		d.publishChanges(ctx, *event)
+	}
+}
+
+// writeChanges returns the changed keys of a data modification statement:
+//
+//   - the table key of the target table.
+//   - the entry keys of the affected rows, if the WHERE clause is a primary key equality or IN list.
+//   - the type key if the affected rows can not be determined, such as UPDATE without primary key or upsert.
+//
+// The type of the table is resolved by TypeName. The statements on the table of a mutation running through
+// DataChangeNotify are skipped, because the hook records them, an upsert is reported to the hook instead.
+// The change event of the statement is returned as well, nil if there is none.
+func (d *Driver) writeChanges(ctx context.Context, query string, args any) ([]Key, *ChangeEvent) {
+	keys, stmt := statementChanges(query, args)
+	if s := mutationFromContext(ctx); s != nil && s.table == stmt.table {
+		if stmt.upsert {
+			s.upsert = true
+		}
+		return nil, nil
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	event := &ChangeEvent{Type: TypeName(stmt.table), IDs: stmt.ids, Op: ent.OpUpdate}
+	switch {
+	case stmt.insert:
+		event.Op = ent.OpCreate
+	case stmt.delete:
+		event.Op = ent.OpDelete
+	}
+	return keys, event
+}
+
+// statementChanges returns the changed keys and the parsed data modification statement.
+func statementChanges(query string, args any) ([]Key, writeStatement) {
+	argv, _ := args.([]any)
+	stmt, ok := parseWrite(query, argv)
+	if !ok {
+		return nil, stmt
+	}
+	typ := TypeName(stmt.table)
+	keys := []Key{NewTableKey(stmt.table)}
+	switch {
+	case stmt.ids != nil:
+		for _, id := range stmt.ids {
+			keys = append(keys, NewEntryKey(typ, id))
+		}
+	case stmt.insert && !stmt.upsert:
+		// new rows do not affect the cached entries by id.
+	default:
+		keys = append(keys, NewTypeKey(typ))
+	}
+	return keys, stmt
+}
+
+// storeChanges marks the keys changed, evicts the hash entries containing the changed entities, and bumps the
+// generations of the changed types.
+func (d *Driver) storeChanges(keys ...Key) {
+	if len(keys) > 0 {
+		d.leases.revoke(changeLeases(keys)...)
+		d.ChangeSet.Store(keys...)
+		d.evictDeps(keys)
+		d.bumpGenerations(keys)
+	}
+}
+
+// receiveChanges handles the keys stored to the ChangeSet not by the driver, which are received from the other
+// instances or the change sources. The shared generations are bumped by the instance storing the keys.
+func (d *Driver) receiveChanges(keys []Key, remote bool) {
+	d.leases.revoke(changeLeases(keys)...)
+	d.evictDeps(keys)
+	if !remote || !d.gens.shared() {
+		d.bumpGenerations(keys)
+	}
+}
+
+// bumpGenerations bumps the generations of the tables of the type keys if KeyGeneration is enabled.
+func (d *Driver) bumpGenerations(keys []Key) {
+	if !d.KeyGeneration {
+		return
+	}
+	for _, key := range keys {
+		if !strings.HasSuffix(string(key), ":*") {
+			continue
+		}
+		table := TableName(entryType(key))
+		if err := d.gens.bump(context.Background(), table); err != nil {
+			logger.Warn(fmt.Sprintf("entcache: failed bumping generation of %s: %v", table, err))
+		}
+	}
+}
+
+// evictDeps deletes the hash entries whose results contain the changed entities.
+func (d *Driver) evictDeps(keys []Key) {
+	for _, key := range d.deps.evict(keys...) {
+		if err := d.Cache.Del(context.Background(), string(key)); err != nil && !d.Cache.IsNotFound(err) {
+			logger.Warn(fmt.Sprintf("entcache: failed deleting entry %v in cache: %v", key, err))
+		}
+	}
+}
+
+// storeMutationChanges marks the keys changed by a mutation. If the mutation is executed in a transaction of
+// the driver, the keys are buffered until the transaction commits.
+func (d *Driver) storeMutationChanges(ctx context.Context, keys ...Key) {
+	if s := mutationFromContext(ctx); s != nil && s.tx != nil {
+		s.tx.store(keys...)
+		return
+	}
+	d.storeChanges(keys...)
+}
+
+// publishChanges sends the change events to the subscriptions of the ChangeSet. If the mutation is executed in
+// a transaction of the driver, the events are buffered until the transaction commits.
+func (d *Driver) publishChanges(ctx context.Context, events ...ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	if s := mutationFromContext(ctx); s != nil && s.tx != nil {
+		s.tx.storeEvents(events...)
+		return
+	}
+	d.publish(events...)
+}
+
+// publish sends the change events to the subscriptions, if the ChangeSet supports publishing.
+func (d *Driver) publish(events ...ChangeEvent) {
+	if p, ok := d.ChangeSet.(interface{ publish(...ChangeEvent) }); ok {
+		p.publish(events...)
+	}
+}
+
 // optionsFromContext returns the injected options from the context, or its default value.
 // Note that the key in the context is an entry key, and will replace by hashed query key, that will improve the cache hit rate.
-func (d *Driver) optionsFromContext(ctx context.Context, query string, args []any) (ctxOptions, error) {
+//
+// If the query reads the data mutated by the read-write transaction tx, the cache is skipped.
+func (d *Driver) optionsFromContext(ctx context.Context, tx *Tx, query string, args []any) (ctxOptions, error) {
 	var opts ctxOptions
 	if c, ok := ctx.Value(ctxOptionsKey).(*ctxOptions); ok {
 		opts = *c
@@ -171,41 +501,65 @@ func (d *Driver) optionsFromContext(ctx context.Context, query string, args []an
 			c.key = "" // clear it for eager loading.
 		}
 	}
+	if tx != nil && tx.overlaps(opts.key, query) {
+		return opts, errSkip
+	}
 	key, err := d.Hash(query, args)
 	if err != nil {
 		return opts, errSkip
 	}
+	// the refs are kept by the queries out of transactions, which store the entries.
+	evictRef := d.evictRef
+	if tx != nil {
+		evictRef = d.staleRef
+	}
 	switch {
 	case opts.ref && opts.key != "":
-		if t, ok := d.ChangeSet.Load(opts.key); ok {
-			rt, loaded := d.ChangeSet.LoadOrStoreRef(key)
-			// the first query in the entity changed period, evict the cache;
-			// if the new entity changed happen after the previous query, evict the cache
-			opts.evict = !loaded || t.After(rt)
-		} else if _, ok := d.ChangeSet.LoadRef(key); ok {
+		t, ok := d.entryChanged(opts.key)
+		// the reference entry is evicted by the changed fields it reads.
+		if ft, changed := d.fieldsChanged(opts.key, query); changed && (!ok || ft.After(t)) {
+			t, ok = ft, true
+		}
+		if evictRef(key, t, ok) {
 			opts.evict = true
-			d.ChangeSet.DeleteRef(key)
 		}
 		if opts.ttl == 0 {
 			opts.ttl = d.KeyQueryTTL
 		}
 	case opts.key == "":
+		// the hash query is referenced to the tables it reads, the ref is kept apart from the entry key refs
+		// of the same query.
+		t, ok := d.tablesChanged(query)
+		if evictRef("tables:"+key, t, ok) {
+			opts.evict = true
+		}
+		if tables := queryTables(query); len(tables) > 0 {
+			opts.typ = TypeName(tables[0])
+		}
 		if opts.ttl == 0 {
 			opts.ttl = d.HashQueryTTL
 		}
 	case opts.key != "":
-		if _, ok := d.ChangeSet.Load(opts.key); ok {
+		// the keyed query reads all fields, it is evicted by any changed field as well. The marks may be shared
+		// by the other instances, such as by CacheChangeSet, so they are compared by ref rather than deleted.
+		t, ok := d.entryChanged(opts.key)
+		if ft, changed := d.ChangeSet.Load(fieldKey(opts.key, "")); changed && (!ok || ft.After(t)) {
+			t, ok = ft, true
+		}
+		if evictRef("entry:"+key, t, ok) {
 			opts.evict = true
-			d.ChangeSet.Delete(opts.key)
 		}
 		if opts.ttl == 0 {
 			opts.ttl = d.KeyQueryTTL
 		}
 	}
+	if opts.softTTL == 0 {
+		opts.softTTL = d.SoftTTL
+	}
 	// use hashed key as the cache key
-	opts.key = key
-	if d.CachePrefix != "" {
-		opts.key = Key(d.CachePrefix) + opts.key
+	if opts.key, err = d.cacheKey(ctx, key, query); err != nil {
+		logger.Warn(err.Error())
+		return opts, errSkip
 	}
 	if opts.skipMode == cache.SkipCache {
 		return opts, errSkip
@@ -213,6 +567,108 @@ func (d *Driver) optionsFromContext(ctx context.Context, query string, args []an
 	return opts, nil
 }
 
+// CacheKey returns the key of the entry cached by the query and args. It is the Hash of the query, mixed with
+// the generations of the tables if KeyGeneration is enabled, and prefixed by CachePrefix.
+func (d *Driver) CacheKey(ctx context.Context, query string, args []any) (Key, error) {
+	key, err := d.Hash(query, args)
+	if err != nil {
+		return "", err
+	}
+	return d.cacheKey(ctx, key, query)
+}
+
+// cacheKey returns the cache key of the hashed key of the query.
+func (d *Driver) cacheKey(ctx context.Context, key Key, query string) (Key, error) {
+	if d.KeyGeneration {
+		gens, err := d.gens.load(ctx, queryTables(query))
+		if err != nil {
+			return "", fmt.Errorf("entcache: failed loading generations: %w", err)
+		}
+		key = withGenerations(key, gens)
+	}
+	if d.CachePrefix != "" {
+		key = Key(d.CachePrefix) + key
+	}
+	return key, nil
+}
+
+// evictRef reports whether the entry referencing changed data should be evicted. changed is the latest change
+// time of the referenced data and ok reports whether it is in the changed period.
+func (d *Driver) evictRef(key Key, changed time.Time, ok bool) bool {
+	if ok {
+		rt, loaded := d.ChangeSet.LoadOrStoreRef(key)
+		// the first query in the changed period, evict the cache;
+		// if the new change happen after the previous query, evict the cache
+		return !loaded || changed.After(rt)
+	}
+	// the ref is only stored in the changed period, it exists means the entry may be stale.
+	if _, ok := d.ChangeSet.LoadRef(key); ok {
+		d.ChangeSet.DeleteRef(key)
+		return true
+	}
+	return false
+}
+
+// staleRef reports whether the entry referencing changed data may be stale the same as evictRef, but it does not
+// update the ref.
+func (d *Driver) staleRef(key Key, changed time.Time, ok bool) bool {
+	rt, loaded := d.ChangeSet.LoadRef(key)
+	if ok {
+		return !loaded || changed.After(rt)
+	}
+	return loaded
+}
+
+// entryChanged returns the latest change time of the entry key and its type.
+func (d *Driver) entryChanged(key Key) (latest time.Time, ok bool) {
+	for _, k := range []Key{key, NewTypeKey(entryType(key))} {
+		if t, changed := d.ChangeSet.Load(k); changed {
+			if t.After(latest) {
+				latest = t
+			}
+			ok = true
+		}
+	}
+	return
+}
+
+// fieldsChanged returns the latest change time of the fields of the entry key read by the query. The fields are
+// matched by the identifiers in the query, so the ones in the predicates are included. A query projecting all
+// columns, such as SELECT *, is matched by any changed field.
+func (d *Driver) fieldsChanged(key Key, query string) (latest time.Time, ok bool) {
+	fields := queryIdents(query)
+	if selectsAll(query) {
+		fields = append(fields, "")
+	}
+	for _, field := range fields {
+		if t, changed := d.ChangeSet.Load(fieldKey(key, field)); changed {
+			if t.After(latest) {
+				latest = t
+			}
+			ok = true
+		}
+	}
+	return
+}
+
+// tablesChanged returns the latest change time of the tables read by the query.
+func (d *Driver) tablesChanged(query string) (latest time.Time, ok bool) {
+	for _, table := range queryTables(query) {
+		if t, changed := d.ChangeSet.Load(NewTableKey(table)); changed {
+			if t.After(latest) {
+				latest = t
+			}
+			ok = true
+		}
+	}
+	return
+}
+
+// isSelect reports whether the statement looks like a standard Ent query.
+func isSelect(query string) bool {
+	return strings.HasPrefix(query, "SELECT") || strings.HasPrefix(query, "select")
+}
+
 // rawCopy copies the driver values by implementing
 // the sql.Scanner interface.
 type rawCopy struct {
@@ -238,6 +694,8 @@ type recorder struct {
 	columns []string
 	done    bool
 	onClose func([]string, [][]driver.Value)
+	// onDone is called after the recorder is closed, whether the entry is stored or not.
+	onDone func()
 }
 
 // Next wraps the underlying Next method
@@ -282,6 +740,9 @@ func (r *recorder) Columns() ([]string, error) {
 }
 
 func (r *recorder) Close() error {
+	if r.onDone != nil {
+		defer r.onDone()
+	}
 	if err := r.ColumnScanner.Close(); err != nil {
 		return err
 	}
@@ -2,6 +2,10 @@ package entcache
 
 import (
 	"context"
+	stdsql "database/sql"
+	"database/sql/driver"
+	"entgo.io/ent"
+	"entgo.io/ent/dialect"
 	"entgo.io/ent/dialect/sql"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/suite"
@@ -9,6 +13,10 @@ import (
 	"github.com/tsingsun/woocoo/pkg/cache/lfu"
 	"github.com/tsingsun/woocoo/pkg/cache/redisc"
 	"github.com/tsingsun/woocoo/pkg/conf"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -173,7 +181,9 @@ func (t *driverSuite) TestWithXXEntryKey() {
 		t.Equal(uint64(0), drv.stats.Hits)
 		drv.ChangeSet.Store("User:1")
 		query(drv, WithEntryKey(ctx, "User", 1), all, []any{1})
-		t.Len(drv.ChangeSet.changes, 0)
+		t.Equal(uint64(0), drv.stats.Hits)
+		_, ok := drv.ChangeSet.Load("User:1")
+		t.True(ok, "the mark is kept for the other instances")
 
 		query(drv, Evict(context.Background()), all, []any{1})
 		t.Equal(uint64(0), drv.stats.Hits)
@@ -218,6 +228,7 @@ func (t *driverSuite) TestTx() {
 func (t *driverSuite) TestGC() {
 	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
 		"hashQueryTTL": time.Second,
+		"keyQueryTTL":  time.Second,
 		"name":         "gc",
 	})), WithChangeSet(NewChangeSet(time.Second*2)))
 	ctx, concel := context.WithTimeout(context.Background(), time.Second*5)
@@ -228,6 +239,1167 @@ func (t *driverSuite) TestGC() {
 	drv.ChangeSet.LoadOrStoreRef("ref:1")
 	drv.ChangeSet.LoadOrStoreRef("ref:2")
 	time.Sleep(time.Second * 3)
-	t.Equal(0, len(drv.ChangeSet.changes))
-	t.Equal(0, len(drv.ChangeSet.refs))
+	cs := drv.ChangeSet.(*MemoryChangeSet)
+	stats := cs.Stats()
+	t.Equal(0, stats.Changes)
+	t.Equal(0, stats.Refs)
+	t.Equal(2*time.Second, stats.Retention)
+}
+
+func (t *driverSuite) TestChangeSetBound() {
+	cs := NewChangeSet(time.Minute, WithMaxSize(changeSetShards))
+	cs.retain(time.Hour)
+	t.Equal(time.Hour, cs.Stats().Retention)
+	cs.retain(time.Second)
+	t.Equal(time.Hour, cs.Stats().Retention, "the retention is the longest ttl")
+
+	// a shard holds one mark, find two keys of the same shard.
+	first := Key("User:1")
+	var second Key
+	for i := 2; second == ""; i++ {
+		if k := NewEntryKey("User", strconv.Itoa(i)); cs.changes.shard(k) == cs.changes.shard(first) {
+			second = k
+		}
+	}
+	cs.Store(first)
+	cs.Store(second)
+	_, ok := cs.Load(first)
+	t.False(ok, "the oldest mark is dropped")
+	_, ok = cs.Load(second)
+	t.True(ok)
+	_, ok = cs.Load(NewTypeKey("User"))
+	t.True(ok, "the dropped entity is covered by its type")
+	stats := cs.Stats()
+	t.Equal(uint64(1), stats.DroppedChanges)
+	t.LessOrEqual(stats.Changes, changeSetShards)
+
+	for i := 0; i < 10*changeSetShards; i++ {
+		cs.LoadOrStoreRef(Key("ref:" + strconv.Itoa(i)))
+	}
+	stats = cs.Stats()
+	t.LessOrEqual(stats.Refs, changeSetShards)
+	t.Positive(stats.DroppedRefs)
+
+	t.Run("lost", func() {
+		cs := NewChangeSet(time.Minute, WithMaxSize(changeSetShards))
+		table := NewTableKey("users")
+		var other, entity Key
+		for i := 0; other == "" || entity == ""; i++ {
+			k := NewTableKey("t" + strconv.Itoa(i))
+			if cs.changes.shard(k) == cs.changes.shard(table) && other == "" {
+				other = k
+			}
+			k = NewEntryKey("Group", strconv.Itoa(i))
+			if cs.changes.shard(k) == cs.changes.shard(table) && entity == "" {
+				entity = k
+			}
+		}
+		cs.Store(table)
+		tt, _ := cs.Load(table)
+		cs.Store(entity)
+		lt, ok := cs.Load(table)
+		t.True(ok, "the dropped table mark is reported by the lost time")
+		t.True(tt.Equal(lt))
+		_, ok = cs.Load(other)
+		t.True(ok, "all tables of the shard are reported changed")
+		_, ok = cs.Load(entity)
+		t.True(ok)
+
+		cs.changes.expire(time.Now().Add(time.Second))
+		_, ok = cs.Load(table)
+		t.False(ok, "the lost time is out of the retention")
+	})
+	t.Run("batch", func() {
+		const limit = 16
+		cs := NewChangeSet(time.Minute, WithMaxSize(limit*changeSetShards))
+		var keys []Key
+		for i := 0; len(keys) <= limit; i++ {
+			if k := NewEntryKey("User", strconv.Itoa(i)); cs.changes.shard(k) == cs.changes.shard("User:0") {
+				keys = append(keys, k)
+			}
+		}
+		now := time.Now()
+		for i, k := range keys {
+			cs.store(now.Add(time.Duration(i)*time.Millisecond), k)
+		}
+		t.Equal(uint64(limit/evictFraction), cs.Stats().DroppedChanges, "a fraction of the shard is made room at once")
+		for _, k := range keys[:limit/evictFraction] {
+			_, ok := cs.changes.get(k)
+			t.False(ok, "the oldest marks are dropped")
+		}
+	})
+}
+
+func (t *driverSuite) TestCacheChangeSet() {
+	cnf := conf.NewFromStringMap(map[string]any{
+		"addrs": []string{t.Redis.Addr()},
+		"local": map[string]any{
+			"size": 100,
+			"ttl":  "1m",
+		},
+	})
+	rc, err := redisc.New(cnf)
+	t.Require().NoError(err)
+	cs := NewCacheChangeSet(rc, time.Minute)
+	node1 := NewDriver(t.DB, WithCache(rc), WithChangeSet(cs), WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"name": "sharedChangeSet1",
+	})))
+	node2 := NewDriver(t.DB, WithCache(rc), WithChangeSet(NewCacheChangeSet(rc, time.Minute)),
+		WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name": "sharedChangeSet2",
+		})))
+	query := func(drv *Driver) {
+		rows := &sql.Rows{}
+		ctx := WithEntryKey(context.Background(), "User", 1)
+		t.Require().NoError(drv.Query(ctx, "SELECT * FROM users where id=?", []any{1}, rows))
+		_ = rows.Close()
+	}
+	query(node1)
+	query(node2)
+	t.Equal(uint64(1), node2.stats.Hits)
+
+	node1.ChangeSet.Store("User:1")
+	_, ok := node2.ChangeSet.Load("User:1")
+	t.True(ok, "the mark is shared by cache")
+	query(node2)
+	t.Equal(uint64(1), node2.stats.Hits, "evicted by the shared mark")
+	query(node2)
+	t.Equal(uint64(2), node2.stats.Hits, "evicted once")
+	_, ok = node1.ChangeSet.Load("User:1")
+	t.True(ok, "the mark is kept for the other instances")
+	query(node1)
+	t.Equal(uint64(0), node1.stats.Hits, "node1 evicts its local copy as well")
+	query(node1)
+	t.Equal(uint64(1), node1.stats.Hits)
+
+	_, loaded := cs.LoadOrStoreRef("ref:1")
+	t.False(loaded)
+	_, loaded = cs.LoadOrStoreRef("ref:1")
+	t.True(loaded)
+	cs.DeleteRef("ref:1")
+	_, ok = cs.LoadRef("ref:1")
+	t.False(ok)
+}
+
+func (t *driverSuite) TestTableChanged() {
+	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"hashQueryTTL": time.Minute,
+		"name":         "tableChanged",
+	})))
+	query := func(q string) {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(context.Background(), q, []any{}, rows))
+		for rows.Next() {
+		}
+		_ = rows.Close()
+	}
+	query("SELECT COUNT(*) FROM users")
+	query("SELECT COUNT(*) FROM users")
+	t.Equal(uint64(1), drv.stats.Hits)
+
+	drv.ChangeSet.Store(NewTableKey("users"))
+	query("SELECT COUNT(*) FROM users")
+	t.Equal(uint64(1), drv.stats.Hits, "evicted by the table change")
+	query("SELECT COUNT(*) FROM users")
+	t.Equal(uint64(2), drv.stats.Hits, "refreshed after the change")
+	drv.ChangeSet.Store(NewTableKey("todos"))
+	query("SELECT COUNT(*) FROM users")
+	t.Equal(uint64(3), drv.stats.Hits, "not affected by other table")
+}
+
+func (t *driverSuite) TestExec() {
+	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"hashQueryTTL": time.Minute,
+		"name":         "exec",
+	})))
+	ctx := context.Background()
+	t.Require().NoError(drv.Exec(ctx, "insert into users values (?,?)", []any{10, 10.1}, nil))
+	_, ok := drv.ChangeSet.Load(NewTableKey("users"))
+	t.True(ok)
+	_, ok = drv.ChangeSet.Load(NewTypeKey("User"))
+	t.False(ok, "insert does not change the existing entities")
+
+	get := func() {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(WithEntryKey(ctx, "User", 10), "SELECT * FROM users where id=?", []any{10}, rows))
+		_ = rows.Close()
+	}
+	get()
+	t.Require().NoError(drv.Exec(ctx, "update users set age = ? where id = ?", []any{10.2, 10}, nil))
+	_, ok = drv.ChangeSet.Load("User:10")
+	t.True(ok)
+	get()
+	t.Equal(uint64(0), drv.stats.Hits)
+	get()
+	t.Equal(uint64(1), drv.stats.Hits)
+
+	t.Require().NoError(drv.Exec(ctx, "update users set age = age + 1 where age > ?", []any{100}, nil))
+	_, ok = drv.ChangeSet.Load(NewTypeKey("User"))
+	t.True(ok, "the affected rows are undetermined")
+	get()
+	t.Equal(uint64(1), drv.stats.Hits, "evicted by the type change")
+	get()
+	t.Equal(uint64(2), drv.stats.Hits)
+
+	marked, _ := drv.ChangeSet.Load("User:10")
+	t.Require().NoError(drv.Exec(newMutationContext(ctx, "users"), "delete from users where id = ?", []any{10}, nil))
+	tm, _ := drv.ChangeSet.Load("User:10")
+	t.Equal(marked, tm, "the statement is recorded by hook")
+}
+
+func (t *driverSuite) TestLimit() {
+	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"name": "limit",
+	})))
+	ctx := context.Background()
+	t.Require().NoError(t.DB.Exec(ctx, "insert or ignore into users values (?,?),(?,?)", []any{40, 1, 41, 1}, nil))
+	rows := &sql.Rows{}
+	t.Require().NoError(drv.Query(limitContext(ctx, 1), "SELECT id FROM users WHERE age = ?", []any{1}, rows))
+	defer rows.Close()
+	var n int
+	for rows.Next() {
+		n++
+	}
+	t.Equal(1, n)
+}
+
+func (t *driverSuite) TestTxChanges() {
+	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"hashQueryTTL": time.Minute,
+		"txEvictDelay": 100 * time.Millisecond,
+		"name":         "txChanges",
+	})))
+	ctx := context.Background()
+	t.Run("commit", func() {
+		tx, err := drv.Tx(ctx)
+		t.Require().NoError(err)
+		t.Require().NoError(tx.Exec(ctx, "update users set age = ? where id = ?", []any{20.2, 1}, nil))
+		// simulate the hook of a mutation in the transaction.
+		mctx := newMutationContext(ctx, "todos")
+		t.Require().NoError(tx.Exec(mctx, "update users set age = ? where id = ?", []any{20.1, 1}, nil))
+		drv.storeMutationChanges(mctx, "Todo:1")
+		_, ok := drv.ChangeSet.Load("User:1")
+		t.False(ok, "buffered before commit")
+		_, ok = drv.ChangeSet.Load("Todo:1")
+		t.False(ok, "buffered before commit")
+		t.Require().NoError(tx.Commit())
+		_, ok = drv.ChangeSet.Load("User:1")
+		t.True(ok)
+		_, ok = drv.ChangeSet.Load("Todo:1")
+		t.True(ok)
+
+		drv.ChangeSet.Delete("User:1")
+		t.Eventually(func() bool {
+			_, ok := drv.ChangeSet.Load("User:1")
+			return ok
+		}, time.Second, 10*time.Millisecond, "stored again after delay")
+	})
+	t.Run("rollback", func() {
+		tx, err := drv.Tx(ctx)
+		t.Require().NoError(err)
+		t.Require().NoError(tx.Exec(ctx, "update users set age = ? where id = ?", []any{20.2, 100}, nil))
+		t.Require().NoError(tx.Rollback())
+		_, ok := drv.ChangeSet.Load("User:100")
+		t.False(ok)
+	})
+}
+
+func (t *driverSuite) TestTxQuery() {
+	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"hashQueryTTL": time.Minute,
+		"name":         "txQuery",
+	})))
+	ctx := context.Background()
+	query := func(q interface {
+		Query(context.Context, string, any, any) error
+	}, query string) (age float64) {
+		rows := &sql.Rows{}
+		t.Require().NoError(q.Query(ctx, query, []any{300}, rows))
+		defer rows.Close()
+		t.Require().True(rows.Next())
+		t.Require().NoError(rows.Scan(&age))
+		return
+	}
+	const q1 = "SELECT age FROM users WHERE id = ?"
+	t.Require().NoError(drv.Exec(ctx, "insert into users values (?,?)", []any{300, 1.0}, nil))
+	t.Equal(1.0, query(drv, q1))
+	t.Run("readWrite", func() {
+		tx, err := drv.BeginTx(ctx, nil)
+		t.Require().NoError(err)
+		defer tx.Rollback()
+		hits := drv.stats.Hits
+		t.Equal(1.0, query(tx, q1))
+		t.Equal(hits+1, drv.stats.Hits, "read the shared cache")
+
+		t.Require().NoError(tx.Exec(ctx, "update users set age = ? where id = ?", []any{2.0, 300}, nil))
+		t.Equal(2.0, query(tx, q1), "read its own writes")
+		t.Equal(hits+1, drv.stats.Hits)
+		t.Equal(2.0, query(tx, "SELECT age FROM users WHERE id = ? LIMIT 1"))
+	})
+	t.Run("readOnly", func() {
+		const q2 = "SELECT age FROM users WHERE id = ? LIMIT 1"
+		hits := drv.stats.Hits
+		t.Equal(1.0, query(drv, q2))
+		t.Equal(hits, drv.stats.Hits, "the miss in read-write transaction is not stored")
+		tx, err := drv.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+		t.Require().NoError(err)
+		hits = drv.stats.Hits
+		t.Equal(1.0, query(tx, q1))
+		t.Equal(1.0, query(tx, q2))
+		t.Equal(hits+2, drv.stats.Hits)
+		t.Require().NoError(tx.Commit())
+	})
+	t.Run("snapshot", func() {
+		// a change committed by another writer, the transaction may read its older snapshot.
+		const q3 = "SELECT age FROM users WHERE id = ? LIMIT 2"
+		drv.ChangeSet.Store(NewTableKey("users"))
+		tx, err := drv.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+		t.Require().NoError(err)
+		hits := drv.stats.Hits
+		t.Equal(1.0, query(tx, q1))
+		t.Equal(1.0, query(tx, q3))
+		t.Equal(hits, drv.stats.Hits, "evicted by the change")
+		t.Require().NoError(tx.Commit())
+		key, err := drv.Hash(q3, []any{300})
+		t.Require().NoError(err)
+		t.False(drv.Cache.Has(ctx, string(key)), "the miss in transaction is not stored")
+		_, ok := drv.ChangeSet.LoadRef("tables:" + key)
+		t.False(ok, "the ref is not updated in transaction")
+		t.Equal(1.0, query(drv, q1))
+		t.Equal(hits, drv.stats.Hits, "evicted out of the transaction")
+	})
+}
+
+func (t *driverSuite) TestFieldChanged() {
+	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"name": "fieldChanged",
+	})))
+	query := func(ctx context.Context) {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(ctx, "SELECT `users`.`age` FROM `users` WHERE `users`.`id` = ?", []any{1}, rows))
+		t.Require().NoError(rows.Close())
+	}
+	ref := func() context.Context {
+		return WithRefEntryKey(context.Background(), "User", 1)
+	}
+	query(ref())
+	hits := drv.stats.Hits
+	drv.ChangeSet.Store(NewFieldKey("User", "1", ""), NewFieldKey("User", "1", "name"))
+	query(ref())
+	t.Equal(hits+1, drv.stats.Hits, "the changed field is not read")
+
+	drv.ChangeSet.Store(NewFieldKey("User", "1", "age"))
+	query(ref())
+	t.Equal(hits+1, drv.stats.Hits, "evicted by the changed field")
+
+	query(WithEntryKey(context.Background(), "User", 1))
+	hits = drv.stats.Hits
+	drv.ChangeSet.Store(NewFieldKey("User", "1", ""))
+	query(WithEntryKey(context.Background(), "User", 1))
+	t.Equal(hits, drv.stats.Hits, "the keyed query reads all fields")
+
+	star := func() {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(ref(), "SELECT `users`.* FROM `users` WHERE `users`.`id` = ?", []any{1}, rows))
+		t.Require().NoError(rows.Close())
+	}
+	star()
+	star()
+	hits = drv.stats.Hits
+	drv.ChangeSet.Store(NewFieldKey("User", "1", ""), NewFieldKey("User", "1", "name"))
+	star()
+	t.Equal(hits, drv.stats.Hits, "the star projection reads all fields")
+	star()
+	t.Equal(hits+1, drv.stats.Hits)
+}
+
+func (t *driverSuite) TestInvalidate() {
+	ctx := context.Background()
+	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"name": "invalidate",
+	})))
+	query := func(ctx context.Context, q string) {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(ctx, q, []any{1}, rows))
+		t.Require().NoError(rows.Close())
+	}
+	const q = "SELECT age FROM users WHERE id = ?"
+	t.Run("ids", func() {
+		query(WithEntryKey(ctx, "User", 1), q)
+		hits := drv.stats.Hits
+		res, err := drv.Invalidate(ctx, "User", 1)
+		t.Require().NoError(err)
+		t.Equal([]Key{"User:1", "table:users"}, res.Keys)
+		query(WithEntryKey(ctx, "User", 1), q)
+		t.Equal(hits, drv.stats.Hits)
+
+		_, err = drv.Invalidate(ctx, "")
+		t.Error(err)
+	})
+	t.Run("type", func() {
+		query(WithRefEntryKey(ctx, "User", 1), q)
+		hits := drv.stats.Hits
+		res, err := drv.InvalidateType(ctx, "User")
+		t.Require().NoError(err)
+		t.Equal([]Key{"User:*", "table:users"}, res.Keys)
+		query(WithEntryKey(ctx, "User", 1), q)
+		t.Equal(hits, drv.stats.Hits)
+	})
+	t.Run("query", func() {
+		query(ctx, q)
+		res, err := drv.InvalidateQuery(ctx, q, []any{1})
+		t.Require().NoError(err)
+		t.Equal(1, res.Removed)
+		res, err = drv.InvalidateQuery(ctx, q, []any{1})
+		t.Require().NoError(err)
+		t.Zero(res.Removed)
+	})
+	t.Run("flush", func() {
+		query(ctx, q)
+		res, err := drv.Flush(ctx)
+		t.Require().NoError(err)
+		t.True(res.All)
+		hits := drv.stats.Hits
+		query(ctx, q)
+		t.Equal(hits, drv.stats.Hits)
+
+		_, err = NewDriver(t.DB, WithCache(mockCache{})).Flush(ctx)
+		t.Error(err)
+	})
+}
+
+func (t *driverSuite) TestFlushRedis() {
+	ctx := context.Background()
+	rc, err := redisc.New(conf.NewFromStringMap(map[string]any{
+		"addrs": []string{t.Redis.Addr()},
+	}))
+	t.Require().NoError(err)
+	t.Require().NoError(rc.Set(ctx, "other", 1))
+	drv := NewDriver(t.DB, WithCache(rc), WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"name": "flushRedis",
+	})))
+	_, err = drv.Flush(ctx)
+	t.Error(err, "a shared cache requires the prefix")
+
+	drv.CachePrefix = "flush:"
+	for i := 1; i <= 3; i++ {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(ctx, "SELECT age FROM users WHERE id = ?", []any{i}, rows))
+		t.Require().NoError(rows.Close())
+	}
+	res, err := drv.Flush(ctx)
+	t.Require().NoError(err)
+	t.Equal(3, res.Removed)
+	t.True(rc.Has(ctx, "other"))
+}
+
+func (t *driverSuite) TestResultDeps() {
+	ctx := context.Background()
+	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"name": "resultDeps",
+	})))
+	const q = "SELECT `users`.`id`, `users`.`age` FROM `users` WHERE `users`.`age` > ?"
+	key, err := drv.Hash(q, []any{1})
+	t.Require().NoError(err)
+	query := func() {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(ctx, q, []any{1}, rows))
+		_, err := rows.Columns()
+		t.Require().NoError(err)
+		for rows.Next() {
+			var (
+				id  int
+				age float64
+			)
+			t.Require().NoError(rows.Scan(&id, &age))
+		}
+		t.Require().NoError(rows.Close())
+		t.Require().True(drv.Cache.Has(ctx, string(key)))
+	}
+	query()
+	drv.storeChanges(NewFieldKey("User", "1", ""), NewFieldKey("User", "1", "name"))
+	t.True(drv.Cache.Has(ctx, string(key)), "the changed field is not in the result")
+	drv.storeChanges(NewFieldKey("User", "2", "age"))
+	t.True(drv.Cache.Has(ctx, string(key)), "the changed entity is not in the result")
+	drv.storeChanges(NewFieldKey("User", "1", "age"))
+	t.False(drv.Cache.Has(ctx, string(key)))
+
+	query()
+	drv.storeChanges(NewEntryKey("User", "1"))
+	t.False(drv.Cache.Has(ctx, string(key)))
+
+	query()
+	drv.ChangeSet.(*MemoryChangeSet).receive(&ChangeMessage{Node: "other", Keys: []Key{NewEntryKey("User", "1")}})
+	t.False(drv.Cache.Has(ctx, string(key)), "evicted by the change of other nodes")
+	t.Empty(drv.deps.results)
+	t.Empty(drv.deps.entities)
+
+	// a source feeding the entity key only, the table key would not evict the entry.
+	query()
+	drv.ChangeSet.(*MemoryChangeSet).storeSource(NewEntryKey("User", "1"))
+	_, ok := drv.ChangeSet.Load(NewTableKey("users"))
+	t.False(ok)
+	hits := drv.stats.Hits
+	query()
+	t.Equal(hits, drv.stats.Hits, "evicted by the index")
+
+	t.Run("gc", func() {
+		query()
+		drv.deps.add(key, "User", []string{"id"}, [][]driver.Value{{int64(1)}}, time.Nanosecond)
+		time.Sleep(time.Millisecond)
+		drv.ChangeSet.(*MemoryChangeSet).gc()
+		t.Empty(drv.deps.results, "removed by the gc loop of the change set")
+		t.Empty(drv.deps.entities)
+	})
+	t.Run("bound", func() {
+		x := newDepIndex(time.Minute, 4)
+		rows := func(ids ...int64) [][]driver.Value {
+			values := make([][]driver.Value, len(ids))
+			for i, id := range ids {
+				values[i] = []driver.Value{id}
+			}
+			return values
+		}
+		x.add("q1", "User", []string{"id"}, rows(1, 2), 0)
+		x.add("q2", "User", []string{"id"}, rows(3, 4), 0)
+		x.add("q1", "User", []string{"id"}, rows(1), 0)
+		x.add("q3", "User", []string{"id"}, rows(5, 6), 0)
+		t.Equal(3, x.size)
+		t.NotContains(x.results, Key("q2"), "the oldest result is dropped")
+		t.Contains(x.results, Key("q1"), "the replaced result is added again")
+		t.NotContains(x.entities, NewEntryKey("User", "3"))
+		x.add("q4", "User", []string{"id"}, rows(1, 2, 3, 4, 5), 0)
+		t.NotContains(x.results, Key("q4"), "larger than the bound")
+		for i := 0; i < 100; i++ {
+			x.add(Key("p"+strconv.Itoa(i)), "User", []string{"id"}, rows(int64(i)), 0)
+		}
+		t.Equal(4, x.size)
+		t.Len(x.results, 4)
+		t.LessOrEqual(len(x.order), 2*len(x.results)+16, "the order is compacted")
+	})
+}
+
+func (t *driverSuite) TestTags() {
+	ctx := context.Background()
+	const q = "SELECT age FROM users WHERE id = ?"
+	query := func(drv *Driver, ctx context.Context) {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(ctx, q, []any{1}, rows))
+		t.Require().NoError(rows.Close())
+	}
+	t.Run("memory", func() {
+		drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name": "tags",
+		})))
+		query(drv, WithTags(ctx, "a", "b"))
+		res, err := drv.InvalidateTags(ctx, "a")
+		t.Require().NoError(err)
+		t.Equal(1, res.Removed)
+		res, err = drv.InvalidateTags(ctx, "b")
+		t.Require().NoError(err)
+		t.Zero(res.Removed, "removed by the other tag")
+	})
+	t.Run("tx", func() {
+		drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name": "tagsTx",
+		})))
+		query(drv, WithTags(ctx, "a"))
+		key, err := drv.Hash(q, []any{1})
+		t.Require().NoError(err)
+		tx, err := drv.Tx(ctx)
+		t.Require().NoError(err)
+		mctx := newMutationContext(ctx, "users")
+		tx.(*Tx).bind(mctx)
+		drv.invalidateMutationTags(mctx, "a")
+		t.True(drv.Cache.Has(ctx, string(key)), "buffered until commit")
+		t.Require().NoError(tx.Commit())
+		t.False(drv.Cache.Has(ctx, string(key)))
+	})
+	t.Run("redis", func() {
+		rc, err := redisc.New(conf.NewFromStringMap(map[string]any{
+			"addrs": []string{t.Redis.Addr()},
+			"local": map[string]any{
+				"size": 100,
+				"ttl":  "1m",
+			},
+		}))
+		t.Require().NoError(err)
+		drv := NewDriver(t.DB, WithCache(rc), WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":        "tagsRedis",
+			"cachePrefix": "tags:",
+		})))
+		query(drv, WithTags(WithTTL(ctx, time.Minute), "a"))
+		t.True(t.Redis.Exists("tags:entcache:tag:a"))
+		t.Greater(t.Redis.TTL("tags:entcache:tag:a"), 59*time.Second)
+		res, err := drv.InvalidateTags(ctx, "a")
+		t.Require().NoError(err)
+		t.Equal(1, res.Removed)
+		t.False(t.Redis.Exists("tags:entcache:tag:a"))
+		hits := drv.stats.Hits
+		query(drv, ctx)
+		t.Equal(hits, drv.stats.Hits, "removed from the local cache as well")
+	})
+}
+
+func (t *driverSuite) TestKeyGeneration() {
+	ctx := context.Background()
+	const q = "SELECT age FROM users WHERE id = ?"
+	query := func(drv *Driver) {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(ctx, q, []any{1}, rows))
+		t.Require().NoError(rows.Close())
+	}
+	t.Run("memory", func() {
+		drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":          "keyGeneration",
+			"keyGeneration": true,
+		})))
+		query(drv)
+		query(drv)
+		t.Equal(uint64(1), drv.stats.Hits)
+		drv.bumpGenerations([]Key{NewTypeKey("User")})
+		query(drv)
+		t.Equal(uint64(1), drv.stats.Hits, "orphaned by the generation")
+		query(drv)
+		t.Equal(uint64(2), drv.stats.Hits)
+
+		drv.ChangeSet.(*MemoryChangeSet).receive(&ChangeMessage{Node: "other", Keys: []Key{NewTypeKey("User")}})
+		gens, err := drv.gens.load(ctx, []string{"users"})
+		t.Require().NoError(err)
+		t.Equal([]int64{2}, gens, "bumped by the change of other nodes")
+	})
+	t.Run("redis", func() {
+		rc, err := redisc.New(conf.NewFromStringMap(map[string]any{
+			"addrs": []string{t.Redis.Addr()},
+		}))
+		t.Require().NoError(err)
+		drv := NewDriver(t.DB, WithCache(rc), WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":          "keyGenerationRedis",
+			"cachePrefix":   "gen:",
+			"keyGeneration": true,
+		})))
+		query(drv)
+		gen, err := t.Redis.Get("gen:entcache:gen:users")
+		t.Require().NoError(err)
+		query(drv)
+		t.Equal(uint64(1), drv.stats.Hits)
+		_, err = drv.InvalidateType(ctx, "User")
+		t.Require().NoError(err)
+		bumped, err := t.Redis.Get("gen:entcache:gen:users")
+		t.Require().NoError(err)
+		t.NotEqual(gen, bumped)
+		query(drv)
+		t.Equal(uint64(1), drv.stats.Hits)
+
+		t.Redis.Del("gen:entcache:gen:users")
+		query(drv)
+		t.Equal(uint64(1), drv.stats.Hits, "a lost counter does not return to a previous generation")
+
+		key, err := drv.CacheKey(ctx, q, []any{1})
+		t.Require().NoError(err)
+		t.True(t.Redis.Exists(string(key)))
+		res, err := drv.InvalidateQuery(ctx, q, []any{1})
+		t.Require().NoError(err)
+		t.Equal(1, res.Removed, "removed by the key with the generations")
+		t.False(t.Redis.Exists(string(key)))
+	})
+}
+
+func (t *driverSuite) TestChangeSetSnapshot() {
+	ctx := context.Background()
+	rc, err := redisc.New(conf.NewFromStringMap(map[string]any{
+		"addrs": []string{t.Redis.Addr()},
+	}))
+	t.Require().NoError(err)
+	stores := map[string]SnapshotStore{
+		"file":  NewFileSnapshot(filepath.Join(t.T().TempDir(), "changeset.json")),
+		"cache": NewCacheSnapshot(rc, "snapshot:test", time.Minute),
+	}
+	for name, store := range stores {
+		t.Run(name, func() {
+			cs := NewChangeSet(time.Minute, WithSnapshot(store))
+			cs.Store("User:1")
+			cs.LoadOrStoreRef("ref:1")
+			cs.store(time.Now().Add(-2*time.Minute), "User:2")
+			t.Require().NoError(cs.Stop(ctx))
+
+			reloaded := NewChangeSet(time.Minute, WithSnapshot(store))
+			t1, ok := reloaded.Load("User:1")
+			t.True(ok)
+			t0, _ := cs.Load("User:1")
+			t.True(t0.Equal(t1))
+			_, ok = reloaded.LoadRef("ref:1")
+			t.True(ok)
+			_, ok = reloaded.Load("User:2")
+			t.True(ok, "kept until the retention is known")
+			reloaded.gc()
+			_, ok = reloaded.Load("User:2")
+			t.False(ok, "pruned by age")
+		})
+	}
+	t.Run("retention", func() {
+		store := NewFileSnapshot(filepath.Join(t.T().TempDir(), "retention.json"))
+		cs := NewChangeSet(time.Minute, WithSnapshot(store))
+		cs.store(time.Now().Add(-2*time.Minute), "User:1")
+		cs.store(time.Now().Add(-10*time.Minute), "User:2")
+		t.Require().NoError(cs.Stop(ctx))
+
+		reloaded := NewChangeSet(time.Minute, WithSnapshot(store))
+		NewDriver(t.DB, WithChangeSet(reloaded), WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":         "snapshotRetention",
+			"keyQueryTTL":  time.Minute,
+			"hashQueryTTL": 5 * time.Minute,
+		})))
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		t.Require().NoError(reloaded.Start(ctx))
+		_, ok := reloaded.Load("User:1")
+		t.True(ok, "kept by the retention of the ttl longer than the gc interval")
+		_, ok = reloaded.Load("User:2")
+		t.False(ok)
+	})
+	t.Run("none", func() {
+		cs := NewChangeSet(time.Minute, WithSnapshot(NewFileSnapshot(filepath.Join(t.T().TempDir(), "none.json"))))
+		_, ok := cs.Load("User:1")
+		t.False(ok)
+	})
+}
+
+func (t *driverSuite) TestSubscribe() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"name": "subscribe",
+	})), WithChangeSet(NewChangeSet(time.Minute)))
+	next := func(ch <-chan ChangeEvent) ChangeEvent {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(time.Second):
+			t.FailNow("no event")
+			return ChangeEvent{}
+		}
+	}
+	t.Run("statement", func() {
+		events := drv.ChangeSet.Subscribe(ctx, ChangeFilter{Types: []string{"User"}, Op: ent.OpUpdate | ent.OpDelete})
+		t.Require().NoError(drv.Exec(ctx, "insert into users values (?,?)", []any{10, 1.0}, nil))
+		t.Require().NoError(drv.Exec(ctx, "update users set age = ? where id = ?", []any{2.0, 10}, nil))
+		t.Require().NoError(drv.Exec(ctx, "delete from users where id = ?", []any{10}, nil))
+		e := next(events)
+		t.Equal(ent.OpUpdate, e.Op, "the create is filtered")
+		t.Equal([]string{"10"}, e.IDs)
+		t.False(e.Time.IsZero())
+		t.Equal(ent.OpDelete, next(events).Op)
+	})
+	t.Run("tx", func() {
+		events := drv.ChangeSet.Subscribe(ctx, ChangeFilter{})
+		tx, err := drv.Tx(ctx)
+		t.Require().NoError(err)
+		t.Require().NoError(tx.Exec(ctx, "update users set age = ? where id = ?", []any{2.0, 1}, nil))
+		t.Empty(events, "buffered until commit")
+		t.Require().NoError(tx.Commit())
+		t.Equal([]string{"1"}, next(events).IDs)
+
+		tx, err = drv.Tx(ctx)
+		t.Require().NoError(err)
+		t.Require().NoError(tx.Exec(ctx, "update users set age = ? where id = ?", []any{2.0, 1}, nil))
+		t.Require().NoError(tx.Rollback())
+		_, err = drv.Invalidate(ctx, "User", 2)
+		t.Require().NoError(err)
+		e := next(events)
+		t.Equal([]string{"2"}, e.IDs, "the rollback is dropped")
+		t.Zero(e.Op)
+	})
+	t.Run("remote", func() {
+		cs := drv.ChangeSet.(*MemoryChangeSet)
+		events := cs.Subscribe(ctx, ChangeFilter{Types: []string{"User", "Group"}, Op: ent.OpCreate})
+		cs.receive(&ChangeMessage{Node: "other", Keys: []Key{"table:users", "User:1#", "User:1#age", "User:2#name", "Group:*", "Group:1"}})
+		e := next(events)
+		t.Equal(ChangeEvent{Type: "User", IDs: []string{"1", "2"}, Fields: []string{"age", "name"}, Time: e.Time}, e,
+			"the unknown operation matches any filter")
+		e = next(events)
+		t.Equal("Group", e.Type)
+		t.Empty(e.IDs, "the whole type changed")
+	})
+	t.Run("drop", func() {
+		sctx, scancel := context.WithCancel(ctx)
+		newest := drv.ChangeSet.Subscribe(sctx, ChangeFilter{}, WithEventBuffer(2))
+		oldest := drv.ChangeSet.Subscribe(sctx, ChangeFilter{}, WithEventBuffer(2), WithDropPolicy(DropOldest))
+		for i := 1; i <= 3; i++ {
+			_, err := drv.InvalidateType(ctx, "Drop"+strconv.Itoa(i))
+			t.Require().NoError(err)
+		}
+		t.Equal("Drop1", next(newest).Type)
+		t.Equal("Drop2", next(newest).Type)
+		t.Empty(newest)
+		t.Equal("Drop2", next(oldest).Type)
+		t.Equal("Drop3", next(oldest).Type)
+		scancel()
+		t.Eventually(func() bool {
+			_, ok := <-newest
+			return !ok
+		}, time.Second, 10*time.Millisecond, "closed with the context")
+	})
+}
+
+// gateDriver counts the queries, and blocks them until the gate is closed if it is set.
+type gateDriver struct {
+	*sql.Driver
+	queries atomic.Int32
+	gate    chan struct{}
+}
+
+func (d *gateDriver) Query(ctx context.Context, query string, args, v any) error {
+	d.queries.Add(1)
+	if d.gate != nil {
+		<-d.gate
+	}
+	return d.Driver.Query(ctx, query, args, v)
+}
+
+func (t *driverSuite) TestSingleFlight() {
+	const q = "SELECT age FROM users WHERE id = ?"
+	read := func(drv *Driver, ctx context.Context) (float64, error) {
+		rows := &sql.Rows{}
+		if err := drv.Query(ctx, q, []any{1}, rows); err != nil {
+			return 0, err
+		}
+		defer rows.Close()
+		var age float64
+		if _, err := rows.Columns(); err != nil {
+			return 0, err
+		}
+		if !rows.Next() {
+			return 0, stdsql.ErrNoRows
+		}
+		if err := rows.Scan(&age); err != nil {
+			return 0, err
+		}
+		// read all rows as ent does.
+		for rows.Next() {
+		}
+		return age, rows.Err()
+	}
+	t.Run("coalesce", func() {
+		db := &gateDriver{Driver: t.DB, gate: make(chan struct{})}
+		drv := NewDriver(db, WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":         "singleFlight",
+			"singleFlight": true,
+		})))
+		var wg sync.WaitGroup
+		ages := make([]float64, 5)
+		for i := range ages {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				age, err := read(drv, context.Background())
+				t.NoError(err)
+				ages[i] = age
+			}(i)
+		}
+		t.Eventually(func() bool {
+			return db.queries.Load() == 1
+		}, time.Second, 10*time.Millisecond)
+		time.Sleep(50 * time.Millisecond)
+		close(db.gate)
+		wg.Wait()
+		t.EqualValues(1, db.queries.Load(), "one query for the concurrent misses")
+		t.Equal(uint64(4), drv.stats.Coalesced)
+		for _, age := range ages {
+			t.Equal(ages[0], age)
+		}
+	})
+	t.Run("leaderCanceled", func() {
+		db := &gateDriver{Driver: t.DB}
+		drv := NewDriver(db, WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":         "singleFlightCancel",
+			"singleFlight": true,
+		})))
+		ctx, cancel := context.WithCancel(context.Background())
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(ctx, q, []any{1}, rows))
+		done := make(chan error)
+		go func() {
+			_, err := read(drv, context.Background())
+			done <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		t.EqualValues(1, db.queries.Load(), "the follower waits for the leader")
+		cancel()
+		select {
+		case err := <-done:
+			t.NoError(err)
+		case <-time.After(time.Second):
+			t.Fail("the follower is not released")
+		}
+		t.EqualValues(2, db.queries.Load(), "the follower runs the query after the leader canceled")
+		t.Zero(drv.stats.Coalesced)
+		t.NoError(rows.Close())
+
+		_, err := read(drv, context.Background())
+		t.NoError(err)
+		t.EqualValues(2, db.queries.Load(), "cached by the follower")
+	})
+	t.Run("leaderPartial", func() {
+		db := &gateDriver{Driver: t.DB}
+		drv := NewDriver(db, WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":         "singleFlightPartial",
+			"singleFlight": true,
+		})))
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(context.Background(), q, []any{1}, rows))
+		done := make(chan error)
+		go func() {
+			_, err := read(drv, context.Background())
+			done <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		// the leader stops before all rows are read.
+		_, err := rows.Columns()
+		t.Require().NoError(err)
+		t.Require().True(rows.Next())
+		var age float64
+		t.Require().NoError(rows.Scan(&age))
+		t.Require().NoError(rows.Close())
+		select {
+		case err := <-done:
+			t.NoError(err)
+		case <-time.After(time.Second):
+			t.Fail("the follower is not released")
+		}
+		t.EqualValues(2, db.queries.Load(), "the partial rows are not shared")
+		t.Zero(drv.stats.Coalesced)
+	})
+	t.Run("followerCanceled", func() {
+		db := &gateDriver{Driver: t.DB, gate: make(chan struct{})}
+		drv := NewDriver(db, WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":         "singleFlightFollower",
+			"singleFlight": true,
+		})))
+		go read(drv, context.Background()) //nolint:errcheck
+		t.Eventually(func() bool {
+			return db.queries.Load() == 1
+		}, time.Second, 10*time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		_, err := read(drv, ctx)
+		t.ErrorIs(err, context.DeadlineExceeded)
+		close(db.gate)
+	})
+}
+
+func (t *driverSuite) TestFillLock() {
+	const q = "SELECT age FROM users WHERE id = ?"
+	read := func(drv *Driver) error {
+		rows := &sql.Rows{}
+		if err := drv.Query(context.Background(), q, []any{1}, rows); err != nil {
+			return err
+		}
+		defer rows.Close()
+		if _, err := rows.Columns(); err != nil {
+			return err
+		}
+		var age float64
+		for rows.Next() {
+			if err := rows.Scan(&age); err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	}
+	rc, err := redisc.New(conf.NewFromStringMap(map[string]any{
+		"addrs": []string{t.Redis.Addr()},
+	}))
+	t.Require().NoError(err)
+	newDriver := func(db dialect.Driver, name, prefix string) *Driver {
+		return NewDriver(db, WithCache(rc), WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":         name,
+			"cachePrefix":  prefix,
+			"fillLockTTL":  5 * time.Second,
+			"fillLockWait": 200 * time.Millisecond,
+		})))
+	}
+	t.Run("wait", func() {
+		dbA, dbB := &gateDriver{Driver: t.DB, gate: make(chan struct{})}, &gateDriver{Driver: t.DB}
+		drvA, drvB := newDriver(dbA, "fillLockA", "fill:"), newDriver(dbB, "fillLockB", "fill:")
+		key, err := drvA.Hash(q, []any{1})
+		t.Require().NoError(err)
+		lockKey := "fill:entcache:lock:" + string(key)
+		done := make(chan error, 2)
+		go func() {
+			done <- read(drvA)
+		}()
+		t.Eventually(func() bool {
+			return dbA.queries.Load() == 1 && t.Redis.Exists(lockKey)
+		}, time.Second, 10*time.Millisecond)
+		go func() {
+			done <- read(drvB)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		close(dbA.gate)
+		t.NoError(<-done)
+		t.NoError(<-done)
+		t.Zero(dbB.queries.Load(), "filled by the lock holder")
+		t.Equal(uint64(1), drvB.stats.FillLockHits)
+		t.False(t.Redis.Exists(lockKey), "released after the fill")
+	})
+	t.Run("deadline", func() {
+		db := &gateDriver{Driver: t.DB}
+		drv := newDriver(db, "fillLockDeadline", "deadline:")
+		key, err := drv.Hash(q, []any{1})
+		t.Require().NoError(err)
+		lockKey := "deadline:entcache:lock:" + string(key)
+		t.Require().NoError(t.Redis.Set(lockKey, "crashed"))
+		start := time.Now()
+		t.NoError(read(drv))
+		t.GreaterOrEqual(time.Since(start), 200*time.Millisecond)
+		t.EqualValues(1, db.queries.Load(), "fall back to the database")
+		v, err := t.Redis.Get(lockKey)
+		t.Require().NoError(err)
+		t.Equal("crashed", v, "the lock of the other is kept")
+	})
+	t.Run("released", func() {
+		db := &gateDriver{Driver: t.DB}
+		drv := newDriver(db, "fillLockReleased", "released:")
+		key, err := drv.Hash(q, []any{1})
+		t.Require().NoError(err)
+		lockKey := "released:entcache:lock:" + string(key)
+		t.Require().NoError(t.Redis.Set(lockKey, "failed"))
+		time.AfterFunc(50*time.Millisecond, func() {
+			t.Redis.Del(lockKey)
+		})
+		start := time.Now()
+		t.NoError(read(drv))
+		t.Less(time.Since(start), 200*time.Millisecond, "the lock is taken after the holder failed")
+		t.EqualValues(1, db.queries.Load())
+		t.False(t.Redis.Exists(lockKey))
+	})
+}
+
+func (t *driverSuite) TestLease() {
+	ctx := context.Background()
+	const q = "SELECT age FROM users WHERE id = ?"
+	drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"name": "lease",
+	})))
+	key, err := drv.Hash(q, []any{1})
+	t.Require().NoError(err)
+	// open runs the query missing the cache, the rows are recorded on close.
+	open := func(ctx context.Context) *sql.Rows {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(ctx, q, []any{1}, rows))
+		_, err := rows.Columns()
+		t.Require().NoError(err)
+		for rows.Next() {
+		}
+		return rows
+	}
+	t.Run("revoked", func() {
+		rows := open(ctx)
+		t.Require().NoError(drv.Exec(ctx, "update users set age = age where id = ?", []any{1}, nil))
+		t.Require().NoError(rows.Close())
+		t.False(drv.Cache.Has(ctx, string(key)), "the rows may be read before the change")
+		t.Equal(uint64(1), drv.stats.LeaseRevoked)
+
+		t.Require().NoError(open(ctx).Close())
+		t.True(drv.Cache.Has(ctx, string(key)), "filled by the next query")
+		t.Require().NoError(drv.Cache.Del(ctx, string(key)))
+	})
+	t.Run("otherTable", func() {
+		rows := open(ctx)
+		_, err := drv.Invalidate(ctx, "Group", 1)
+		t.Require().NoError(err)
+		t.Require().NoError(rows.Close())
+		t.True(drv.Cache.Has(ctx, string(key)), "the lease of the table is kept")
+		t.Require().NoError(drv.Cache.Del(ctx, string(key)))
+	})
+	t.Run("tags", func() {
+		rows := open(WithTags(ctx, "lease"))
+		_, err := drv.InvalidateTags(ctx, "lease")
+		t.Require().NoError(err)
+		t.Require().NoError(rows.Close())
+		t.False(drv.Cache.Has(ctx, string(key)))
+	})
+	t.Run("flush", func() {
+		rows := open(ctx)
+		_, err := drv.Flush(ctx)
+		t.Require().NoError(err)
+		t.Require().NoError(rows.Close())
+		t.False(drv.Cache.Has(ctx, string(key)))
+	})
+}
+
+func (t *driverSuite) TestStaleWhileRevalidate() {
+	ctx := context.Background()
+	const q = "SELECT age FROM users WHERE id = ?"
+	read := func(drv *Driver, ctx context.Context) {
+		rows := &sql.Rows{}
+		t.Require().NoError(drv.Query(ctx, q, []any{1}, rows))
+		_, err := rows.Columns()
+		t.Require().NoError(err)
+		for rows.Next() {
+			var age float64
+			t.Require().NoError(rows.Scan(&age))
+		}
+		t.Require().NoError(rows.Close())
+	}
+	entry := func(drv *Driver) Entry {
+		key, err := drv.Hash(q, []any{1})
+		t.Require().NoError(err)
+		var e Entry
+		t.Require().NoError(drv.Cache.Get(ctx, string(key), &e))
+		return e
+	}
+	t.Run("refresh", func() {
+		gd := &gateDriver{Driver: t.DB}
+		drv := NewDriver(gd, WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":         "swr",
+			"hashQueryTTL": time.Minute,
+			"softTTL":      20 * time.Millisecond,
+		})))
+		read(drv, ctx)
+		t.Equal(int32(1), gd.queries.Load())
+		staleAt := entry(drv).StaleAt
+		t.NotZero(staleAt)
+
+		read(drv, ctx)
+		t.Equal(int32(1), gd.queries.Load(), "fresh hit")
+
+		time.Sleep(30 * time.Millisecond)
+		gd.gate = make(chan struct{})
+		cctx, cancel := context.WithCancel(ctx)
+		read(drv, cctx)
+		cancel()
+		read(drv, ctx)
+		t.Equal(uint64(2), drv.stats.StaleHits, "served the stale entry")
+		t.Eventually(func() bool { return gd.queries.Load() == 2 }, time.Second, time.Millisecond)
+		t.Equal(int32(2), gd.queries.Load(), "deduplicated the refreshes")
+
+		close(gd.gate)
+		t.Eventually(func() bool { return entry(drv).StaleAt > staleAt }, time.Second, time.Millisecond,
+			"refreshed with the canceled context detached")
+	})
+	t.Run("withSoftTTL", func() {
+		drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":         "swrCtx",
+			"hashQueryTTL": time.Minute,
+		})))
+		read(drv, ctx)
+		t.Zero(entry(drv).StaleAt, "disabled by default")
+		key, err := drv.Hash(q, []any{1})
+		t.Require().NoError(err)
+		t.Require().NoError(drv.Cache.Del(ctx, string(key)))
+
+		read(drv, WithSoftTTL(WithTTL(ctx, time.Minute), time.Second))
+		t.NotZero(entry(drv).StaleAt)
+	})
+	t.Run("hardTTL", func() {
+		drv := NewDriver(t.DB, WithConfiguration(conf.NewFromStringMap(map[string]any{
+			"name":         "swrHard",
+			"hashQueryTTL": time.Second,
+			"softTTL":      time.Minute,
+		})))
+		read(drv, ctx)
+		t.Zero(entry(drv).StaleAt, "the soft TTL longer than the TTL is ignored")
+	})
 }
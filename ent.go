@@ -3,8 +3,8 @@ package entcache
 import (
 	"context"
 	"entgo.io/ent"
-	"log/slog"
-	"strconv"
+	"fmt"
+	"reflect"
 )
 
 type HookOption func(*hookOptions)
@@ -12,6 +12,15 @@ type HookOption func(*hookOptions)
 type hookOptions struct {
 	// DriverName is the key of the cache.
 	DriverName string
+	// PageSize is the max number of keys stored at once, 0 means no limit.
+	PageSize int
+	// TypeThreshold is the max number of ids invalidated one by one, the whole type is invalidated if more ids are
+	// affected. 0 means no limit.
+	TypeThreshold int
+	// InvalidateType marks the whole type changed on every mutation.
+	InvalidateType bool
+	// Tags returns the tags invalidated by the mutation.
+	Tags func(context.Context, ent.Mutation) []string
 }
 
 // WithDriverName sets which named ent cache driver name to use.
@@ -21,10 +30,74 @@ func WithDriverName(name string) HookOption {
 	}
 }
 
+// WithPageSize sets the max number of keys stored to the ChangeSet at once, the keys of a huge bulk mutation
+// are stored in pages, so that each message published by the Transport is bounded.
+func WithPageSize(size int) HookOption {
+	return func(options *hookOptions) {
+		options.PageSize = size
+	}
+}
+
+// WithTypeThreshold sets the max number of ids invalidated one by one. If a bulk mutation affects more ids,
+// the whole type is invalidated instead. The ids are read with a LIMIT of n+1 rows, so the threshold bounds the
+// work of resolving them as well.
+func WithTypeThreshold(n int) HookOption {
+	return func(options *hookOptions) {
+		options.TypeThreshold = n
+	}
+}
+
+// WithInvalidateType marks the whole type changed on every mutation rather than the mutated entities. With
+// Config.KeyGeneration, the generation of the table is bumped, that orphans all entries of the type at once.
+func WithInvalidateType() HookOption {
+	return func(options *hookOptions) {
+		options.InvalidateType = true
+	}
+}
+
+// WithMutationTags sets the function returning the tags invalidated by a mutation, the entries cached with the
+// tags are removed after the mutation succeeded, see WithTags.
+//
+//	entcache.WithMutationTags(func(ctx context.Context, m ent.Mutation) []string {
+//		return []string{"catalog"}
+//	})
+func WithMutationTags(fn func(context.Context, ent.Mutation) []string) HookOption {
+	return func(options *hookOptions) {
+		options.Tags = fn
+	}
+}
+
 // DataChangeNotify returns a hook that notifies the cache when a mutation is performed.
 //
 // Driver in method is a placeholder for the cache driver name, which is lazy loaded by NewDriver.
-// Use IDs method to get the ids of the mutation, that also works for XXXOne.
+// Use IDs method to get the ids of the mutation, that also works for XXXOne. The ids of bulk update and delete are
+// resolved before the mutation executes, since the mutation may change the fields of the predicates. The ids can
+// be of any type, the keys are built from their canonical string form by fmt.Sprint, and the ids of an edge schema
+// are formatted by CompositeID. If the ids are not exposed by the mutation or fail to resolve, the whole type is
+// marked changed.
+// The creates of the types generated with the sql/upsert feature(see RegisterUpsert), or executing an upsert
+// statement, record the returned ids, since Create().OnConflict() may overwrite the existing rows.
+// Every mutation, include create, also marks the table of the entity changed, see RegisterTable.
+// If the mutation is executed in a transaction of the cached Driver, the keys are stored after the commit.
+// A change event of the mutation is published to the subscriptions of the ChangeSet, see ChangeSet.Subscribe.
+//
+// The entities on the other end of the added or removed edges are marked changed as well, and the whole type
+// on the other end of a cleared edge, since its ids are unknown. The edge types are registered by the generated
+// code, see RegisterEdge.
+//
+// An update records the changed fields of the entities rather than the entities, see NewFieldKey, then the
+// reference entries not reading the fields are kept. The fields of XXXOne equal to the old values are skipped, and
+// an update without any changed field is ignored. Note that the old values are loaded by OldField, which costs one
+// more SELECT of the entity per XXXOne update, and is not locked: if a concurrent writer changes a field between
+// the load and the update, the update restoring the old value is skipped and the entries cached since the
+// concurrent change may keep its value until their TTL. Use WithInvalidateType or the bulk updates for the fields
+// written concurrently. The changes of the edges mark the whole entity changed, since the foreign key columns are
+// not exposed by the mutation. The fields are recorded by their columns, which the queries are matched with, see
+// RegisterColumn; an update of a field not registered marks the whole entity.
+//
+// On delete, the rows changed by the foreign keys in the database, such as ON DELETE CASCADE or SET NULL, are
+// invalidated by their tables and types, see RegisterCascade. The ON UPDATE actions are not supported, since the
+// ids of ent can not be updated.
 func DataChangeNotify(opts ...HookOption) ent.Hook {
 	var options = hookOptions{
 		DriverName: defaultDriverName,
@@ -40,67 +113,248 @@ func DataChangeNotify(opts ...HookOption) ent.Hook {
 	return func(next ent.Mutator) ent.Mutator {
 		return ent.MutateFunc(func(ctx context.Context, m ent.Mutation) (v ent.Value, err error) {
 			op := m.Op()
-			if op.Is(ent.OpCreate) || driver.Config == nil {
+			if driver.Config == nil {
 				return next.Mutate(ctx, m)
 			}
-			var ids []int
+			table := TableName(m.Type())
+			ctx = newMutationContext(ctx, table)
+			var (
+				ids      []string
+				resolved = true
+				// fields are the changed fields of an update, all is set if the whole entity changed.
+				fields []string
+				all    = true
+			)
 			switch op {
-			case ent.OpUpdateOne:
+			case ent.OpCreate:
 				if v, err = next.Mutate(ctx, m); err != nil {
 					return nil, err
 				}
-				if ider, ok := m.(interface {
-					ID() (id int, exists bool)
-				}); ok {
-					if id, ok := ider.ID(); ok {
-						ids = []int{id}
-					}
-				}
-			case ent.OpDeleteOne:
-				if ider, ok := m.(interface {
-					ID() (id int, exists bool)
-				}); ok {
-					if id, ok := ider.ID(); ok {
-						ids = []int{id}
+				// an upsert may overwrite the existing row, the returned id is recorded.
+				if upsertable(m.Type()) || mutationFromContext(ctx).upsert {
+					var id string
+					if id, resolved = mutationID(m); resolved {
+						ids = []string{id}
 					}
 				}
+			case ent.OpUpdateOne:
+				// the old values are read before the mutation executes, the changed fields are collected after it,
+				// that include the fields set by the hooks running inside, such as updated_at.
+				unchanged := unchangedFields(skipCacheContext(ctx), m)
 				if v, err = next.Mutate(ctx, m); err != nil {
 					return nil, err
 				}
-			case ent.OpUpdate:
+				fields, all = changedFields(m, unchanged)
+				var id string
+				if id, resolved = mutationID(m); resolved {
+					ids = []string{id}
+				}
+			case ent.OpDeleteOne:
+				var id string
+				if id, resolved = mutationID(m); resolved {
+					ids = []string{id}
+				}
 				if v, err = next.Mutate(ctx, m); err != nil {
 					return nil, err
 				}
-				if ider, ok := m.(interface {
-					IDs(ctx context.Context) ([]int, error)
-				}); ok {
-					ids, err = ider.IDs(ctx)
-					if err != nil {
-						slog.Error("EntCache getting ids", "err", err)
-						return v, nil
-					}
+			case ent.OpUpdate, ent.OpDelete:
+				// the ids are read from the database rather than the cache, one more than the threshold is enough
+				// to know the whole type is invalidated.
+				idsCtx := skipCacheContext(ctx)
+				if options.TypeThreshold > 0 {
+					idsCtx = limitContext(ctx, options.TypeThreshold+1)
 				}
-			case ent.OpDelete:
-				if ider, ok := m.(interface {
-					IDs(ctx context.Context) ([]int, error)
-				}); ok {
-					ids, err = ider.IDs(ctx)
-					if err != nil {
-						slog.Error("EntCache getting ids", "err", err)
-					}
+				ids, resolved, err = mutationIDs(idsCtx, m)
+				if err != nil {
+					logger.Warn(fmt.Sprintf("entcache: failed getting ids of %s mutation, invalidate the type: %v",
+						m.Type(), err))
+					ids, resolved = nil, false
+				}
+				if options.TypeThreshold > 0 && len(ids) > options.TypeThreshold {
+					// the ids are partial.
+					ids, resolved = nil, false
 				}
 				if v, err = next.Mutate(ctx, m); err != nil {
 					return nil, err
 				}
+				if op == ent.OpUpdate {
+					fields, all = changedFields(m, nil)
+				}
+			}
+			if options.Tags != nil {
+				driver.invalidateMutationTags(ctx, options.Tags(ctx, m)...)
 			}
-			if len(ids) > 0 {
-				var keys = make([]Key, len(ids))
+			if !all && len(fields) == 0 {
+				// no-op update.
+				return v, err
+			}
+			// the field keys are matched with the columns read by the queries.
+			cols, mapped := fieldColumns(m.Type(), fields)
+			var keys []Key
+			switch {
+			case !resolved || options.InvalidateType:
+				// the ids are not exposed by the mutation, such as the bulk mutation of an edge schema,
+				// or too many to invalidate one by one.
+				keys = append(keys, NewTypeKey(m.Type()))
+			case all || !mapped:
+				keys = make([]Key, len(ids), len(ids)+2)
 				for i, id := range ids {
-					keys[i] = NewEntryKey(m.Type(), strconv.Itoa(id))
+					keys[i] = NewEntryKey(m.Type(), id)
+				}
+			default:
+				keys = make([]Key, 0, len(ids)*(len(cols)+1)+2)
+				for _, id := range ids {
+					keys = append(keys, NewFieldKey(m.Type(), id, ""))
+					for _, c := range cols {
+						keys = append(keys, NewFieldKey(m.Type(), id, c))
+					}
+				}
+			}
+			keys = append(keys, NewTableKey(table))
+			keys = append(keys, edgeChanges(m)...)
+			if op.Is(ent.OpDelete | ent.OpDeleteOne) {
+				keys = append(keys, cascadeChanges(m.Type())...)
+			}
+			for len(keys) > 0 {
+				n := len(keys)
+				if options.PageSize > 0 && n > options.PageSize {
+					n = options.PageSize
 				}
-				driver.ChangeSet.Store(keys...)
+				driver.storeMutationChanges(ctx, keys[:n]...)
+				keys = keys[n:]
 			}
+			driver.publishChanges(ctx, mutationEvent(m, ids, resolved, fields, all))
 			return v, err
 		})
 	}
 }
+
+// mutationEvent returns the change event of the mutation. The id of a create is read after it executed.
+func mutationEvent(m ent.Mutation, ids []string, resolved bool, fields []string, all bool) ChangeEvent {
+	event := ChangeEvent{Type: m.Type(), Op: m.Op()}
+	if resolved {
+		event.IDs = ids
+	}
+	if m.Op().Is(ent.OpCreate) && len(ids) == 0 {
+		if id, ok := mutationID(m); ok {
+			event.IDs = []string{id}
+		}
+	}
+	if !all {
+		event.Fields = fields
+	}
+	return event
+}
+
+// edgeChanges returns the keys of the entities on the other end of the edges changed by the mutation.
+func edgeChanges(m ent.Mutation) []Key {
+	var keys []Key
+	for _, edge := range m.AddedEdges() {
+		if target, ok := EdgeType(m.Type(), edge); ok {
+			for _, id := range m.AddedIDs(edge) {
+				keys = append(keys, NewEntryKey(target, fmt.Sprint(id)))
+			}
+		}
+	}
+	for _, edge := range m.RemovedEdges() {
+		if target, ok := EdgeType(m.Type(), edge); ok {
+			for _, id := range m.RemovedIDs(edge) {
+				keys = append(keys, NewEntryKey(target, fmt.Sprint(id)))
+			}
+		}
+	}
+	for _, edge := range m.ClearedEdges() {
+		if target, ok := EdgeType(m.Type(), edge); ok {
+			keys = append(keys, NewTypeKey(target))
+		}
+	}
+	return keys
+}
+
+// unchangedFields returns the fields of the UpdateOne mutation equal to their old values. The old entity is loaded
+// by OldField with one more query of the mutation, without a lock, so a concurrent change after it is not seen.
+func unchangedFields(ctx context.Context, m ent.Mutation) map[string]ent.Value {
+	var unchanged map[string]ent.Value
+	for _, f := range m.Fields() {
+		v, _ := m.Field(f)
+		if old, err := m.OldField(ctx, f); err == nil && reflect.DeepEqual(old, v) {
+			if unchanged == nil {
+				unchanged = make(map[string]ent.Value)
+			}
+			unchanged[f] = v
+		}
+	}
+	return unchanged
+}
+
+// changedFields returns the fields changed by the executed update mutation, include the added and cleared fields.
+// all reports whether the whole entity changed, that is the edges changed. The fields still equal to the values in
+// unchanged are skipped.
+func changedFields(m ent.Mutation, unchanged map[string]ent.Value) (fields []string, all bool) {
+	if len(m.AddedEdges())+len(m.RemovedEdges())+len(m.ClearedEdges()) > 0 {
+		return nil, true
+	}
+	for _, f := range m.Fields() {
+		if old, ok := unchanged[f]; ok {
+			if v, _ := m.Field(f); reflect.DeepEqual(old, v) {
+				continue
+			}
+		}
+		fields = append(fields, f)
+	}
+	fields = append(fields, m.AddedFields()...)
+	fields = append(fields, m.ClearedFields()...)
+	return fields, false
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// mutationID returns the canonical id of the entity mutated by an XXXOne mutation. It calls the generated
+// method `ID() (T, bool)` whatever the id type T is, or reads the id fields of an edge schema.
+func mutationID(m ent.Mutation) (string, bool) {
+	if fields, ok := compositeIDFields(m.Type()); ok {
+		values := make([]any, len(fields))
+		for i, f := range fields {
+			v, ok := m.Field(f)
+			if !ok {
+				return "", false
+			}
+			values[i] = v
+		}
+		return CompositeID(values...), true
+	}
+	method := reflect.ValueOf(m).MethodByName("ID")
+	if !method.IsValid() {
+		return "", false
+	}
+	if t := method.Type(); t.NumIn() != 0 || t.NumOut() != 2 || t.Out(1).Kind() != reflect.Bool {
+		return "", false
+	}
+	out := method.Call(nil)
+	if !out[1].Bool() {
+		return "", false
+	}
+	return fmt.Sprint(out[0].Interface()), true
+}
+
+// mutationIDs returns the canonical ids of the entities matched by the mutation. It calls the generated method
+// `IDs(context.Context) ([]T, error)` whatever the id type T is, ok is false if the method does not exist.
+func mutationIDs(ctx context.Context, m ent.Mutation) (ids []string, ok bool, err error) {
+	method := reflect.ValueOf(m).MethodByName("IDs")
+	if !method.IsValid() {
+		return nil, false, nil
+	}
+	if t := method.Type(); t.NumIn() != 1 || t.NumOut() != 2 || t.Out(0).Kind() != reflect.Slice ||
+		!t.Out(1).Implements(errorType) {
+		return nil, false, nil
+	}
+	out := method.Call([]reflect.Value{reflect.ValueOf(ctx)})
+	if !out[1].IsNil() {
+		return nil, true, out[1].Interface().(error)
+	}
+	ids = make([]string, out[0].Len())
+	for i := range ids {
+		ids[i] = fmt.Sprint(out[0].Index(i).Interface())
+	}
+	return ids, true, nil
+}
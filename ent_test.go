@@ -0,0 +1,403 @@
+package entcache
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+
+	"entgo.io/ent"
+	"github.com/stretchr/testify/assert"
+	"github.com/tsingsun/woocoo/pkg/conf"
+	"github.com/tsingsun/woocoo/pkg/log"
+)
+
+type uuidID [2]byte
+
+func (u uuidID) String() string {
+	return "uuid-" + string(u[:])
+}
+
+type fakeMutation struct {
+	ent.Mutation
+	typ    string
+	op     ent.Op
+	fields map[string]ent.Value
+	old    map[string]ent.Value
+	edges  []string
+	// removed and cleared are the removed and cleared edges, ids are the added or removed ids of the edges.
+	removed []string
+	cleared []string
+	ids     map[string][]ent.Value
+}
+
+func (m fakeMutation) Fields() []string {
+	fields := make([]string, 0, len(m.fields))
+	for f := range m.fields {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func (m fakeMutation) AddedFields() []string {
+	return nil
+}
+
+func (m fakeMutation) ClearedFields() []string {
+	return nil
+}
+
+func (m fakeMutation) OldField(_ context.Context, name string) (ent.Value, error) {
+	if v, ok := m.old[name]; ok {
+		return v, nil
+	}
+	return nil, errors.New("no old value")
+}
+
+func (m fakeMutation) AddedIDs(name string) []ent.Value {
+	return m.ids[name]
+}
+
+func (m fakeMutation) RemovedIDs(name string) []ent.Value {
+	return m.ids[name]
+}
+
+func (m fakeMutation) Type() string {
+	return m.typ
+}
+
+func (m fakeMutation) Op() ent.Op {
+	return m.op
+}
+
+func (m fakeMutation) AddedEdges() []string {
+	return m.edges
+}
+
+func (m fakeMutation) RemovedEdges() []string {
+	return m.removed
+}
+
+func (m fakeMutation) ClearedEdges() []string {
+	return m.cleared
+}
+
+func (m fakeMutation) Field(name string) (ent.Value, bool) {
+	v, ok := m.fields[name]
+	return v, ok
+}
+
+type idMutation[T any] struct {
+	fakeMutation
+	id  *T
+	ids []T
+	err error
+}
+
+func (m idMutation[T]) ID() (id T, exists bool) {
+	if m.id == nil {
+		return
+	}
+	return *m.id, true
+}
+
+func (m idMutation[T]) IDs(context.Context) ([]T, error) {
+	return m.ids, m.err
+}
+
+func TestMutationID(t *testing.T) {
+	var (
+		i64 = int64(1)
+		str = "a"
+		uid = uuidID{'x', 'y'}
+	)
+	tests := []struct {
+		name string
+		m    ent.Mutation
+		id   string
+		ok   bool
+	}{
+		{name: "int64", m: idMutation[int64]{id: &i64}, id: "1", ok: true},
+		{name: "string", m: idMutation[string]{id: &str}, id: "a", ok: true},
+		{name: "uuid", m: idMutation[uuidID]{id: &uid}, id: "uuid-xy", ok: true},
+		{name: "notExists", m: idMutation[int]{}},
+		{name: "noMethod", m: fakeMutation{typ: "Unknown"}},
+		{name: "composite", m: fakeMutation{typ: "Friendship", fields: map[string]ent.Value{
+			"user_id": 1, "friend_id": 2,
+		}}, id: "1,2", ok: true},
+		{name: "compositeMissing", m: fakeMutation{typ: "Friendship", fields: map[string]ent.Value{
+			"user_id": 1,
+		}}},
+	}
+	RegisterCompositeID("Friendship", "user_id", "friend_id")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, ok := mutationID(tt.m)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.id, id)
+		})
+	}
+}
+
+func TestMutationIDs(t *testing.T) {
+	ctx := context.Background()
+	ids, ok, err := mutationIDs(ctx, idMutation[uuidID]{ids: []uuidID{{'a', 'b'}, {'c', 'd'}}})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"uuid-ab", "uuid-cd"}, ids)
+
+	_, ok, err = mutationIDs(ctx, idMutation[string]{err: errors.New("ids")})
+	assert.Error(t, err)
+	assert.True(t, ok)
+
+	_, ok, err = mutationIDs(ctx, fakeMutation{typ: "Friendship"})
+	assert.NoError(t, err)
+	assert.False(t, ok, "edge schema has no ids method")
+}
+
+func TestEdgeChanges(t *testing.T) {
+	RegisterEdge("Pet", "owner", "User")
+	RegisterEdge("Pet", "friends", "Pet")
+	RegisterEdge("Pet", "tags", "Tag")
+	tests := []struct {
+		name string
+		m    fakeMutation
+		keys []Key
+	}{
+		{name: "added", m: fakeMutation{typ: "Pet", edges: []string{"owner"},
+			ids: map[string][]ent.Value{"owner": {1}}}, keys: []Key{"User:1"}},
+		{name: "removed", m: fakeMutation{typ: "Pet", removed: []string{"friends"},
+			ids: map[string][]ent.Value{"friends": {2, 3}}}, keys: []Key{"Pet:2", "Pet:3"}},
+		{name: "cleared", m: fakeMutation{typ: "Pet", cleared: []string{"tags"}}, keys: []Key{NewTypeKey("Tag")}},
+		{name: "all", m: fakeMutation{typ: "Pet", edges: []string{"owner"}, removed: []string{"friends"},
+			cleared: []string{"tags"}, ids: map[string][]ent.Value{"owner": {1}, "friends": {2}}},
+			keys: []Key{"User:1", "Pet:2", NewTypeKey("Tag")}},
+		{name: "unregistered", m: fakeMutation{typ: "Pet", edges: []string{"unknown"}, cleared: []string{"unknown"},
+			ids: map[string][]ent.Value{"unknown": {1}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.keys, edgeChanges(tt.m))
+		})
+	}
+}
+
+// limitMutation records the row limit of resolving the ids.
+type limitMutation struct {
+	idMutation[int]
+	limit int
+}
+
+func (m *limitMutation) IDs(ctx context.Context) ([]int, error) {
+	if c, ok := ctx.Value(ctxOptionsKey).(*ctxOptions); ok {
+		m.limit = c.limit
+	}
+	return m.ids, m.err
+}
+
+type countChangeSet struct {
+	*MemoryChangeSet
+	stores int
+}
+
+func (c *countChangeSet) Store(keys ...Key) {
+	c.stores++
+	c.MemoryChangeSet.Store(keys...)
+}
+
+func TestDataChangeNotify(t *testing.T) {
+	log.InitGlobalLogger()
+	cs := &countChangeSet{MemoryChangeSet: NewChangeSet(time.Minute)}
+	NewDriver(nil, WithConfiguration(conf.NewFromStringMap(map[string]any{
+		"name": "hook",
+	})), WithChangeSet(cs))
+	ctx := context.Background()
+	mutate := func(hook ent.Hook, m ent.Mutation) {
+		// the bulk update changes the fields of the predicate, the ids can not be resolved afterward.
+		next := ent.MutateFunc(func(ctx context.Context, m ent.Mutation) (ent.Value, error) {
+			m.(*idMutation[int]).ids = nil
+			return nil, nil
+		})
+		_, err := hook(next).Mutate(ctx, m)
+		assert.NoError(t, err)
+	}
+	name := map[string]ent.Value{"name": "a"}
+	for _, typ := range []string{"Before", "Page", "Field", "Inner", "Event"} {
+		RegisterColumn(typ, "name", "name")
+		RegisterColumn(typ, "age", "age")
+		RegisterColumn(typ, "updated_at", "updated_at")
+	}
+	t.Run("beforeMutate", func(t *testing.T) {
+		mutate(DataChangeNotify(WithDriverName("hook")), &idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Before", op: ent.OpUpdate, fields: name}, ids: []int{1, 2},
+		})
+		_, ok := cs.Load(NewFieldKey("Before", "1", "name"))
+		assert.True(t, ok)
+		_, ok = cs.Load(NewFieldKey("Before", "2", ""))
+		assert.True(t, ok)
+	})
+	t.Run("page", func(t *testing.T) {
+		cs.stores = 0
+		mutate(DataChangeNotify(WithDriverName("hook"), WithPageSize(2)), &idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Page", op: ent.OpUpdate, fields: name}, ids: []int{1, 2, 3},
+		})
+		assert.Equal(t, 4, cs.stores)
+		_, ok := cs.Load(NewFieldKey("Page", "3", "name"))
+		assert.True(t, ok)
+		_, ok = cs.Load(NewTableKey("pages"))
+		assert.True(t, ok)
+	})
+	t.Run("threshold", func(t *testing.T) {
+		mutate(DataChangeNotify(WithDriverName("hook"), WithTypeThreshold(2)), &idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Threshold", op: ent.OpDelete}, ids: []int{1, 2, 3},
+		})
+		_, ok := cs.Load("Threshold:1")
+		assert.False(t, ok)
+		_, ok = cs.Load(NewTypeKey("Threshold"))
+		assert.True(t, ok)
+
+		m := &limitMutation{idMutation: idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Limit", op: ent.OpDelete}, ids: []int{1, 2, 3},
+		}}
+		_, err := DataChangeNotify(WithDriverName("hook"), WithTypeThreshold(2))(ent.MutateFunc(
+			func(context.Context, ent.Mutation) (ent.Value, error) {
+				return nil, nil
+			})).Mutate(ctx, m)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, m.limit, "one more than the threshold")
+		_, ok = cs.Load(NewTypeKey("Limit"))
+		assert.True(t, ok)
+	})
+	t.Run("upsert", func(t *testing.T) {
+		id := 1
+		RegisterUpsert("Upsert")
+		mutate(DataChangeNotify(WithDriverName("hook")), &idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Upsert", op: ent.OpCreate}, id: &id,
+		})
+		_, ok := cs.Load("Upsert:1")
+		assert.True(t, ok)
+
+		hook := DataChangeNotify(WithDriverName("hook"))
+		_, err := hook(ent.MutateFunc(func(ctx context.Context, m ent.Mutation) (ent.Value, error) {
+			drv := driverManager["hook"]
+			drv.writeChanges(ctx, "INSERT INTO `conflicts` (`name`) VALUES (?) ON CONFLICT DO UPDATE SET `name` = ?", []any{"a", "a"})
+			return nil, nil
+		})).Mutate(ctx, &idMutation[int]{fakeMutation: fakeMutation{typ: "Conflict", op: ent.OpCreate}, id: &id})
+		assert.NoError(t, err)
+		_, ok = cs.Load("Conflict:1")
+		assert.True(t, ok, "upsert statement is reported by the driver")
+
+		mutate(DataChangeNotify(WithDriverName("hook")), &idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Upsert", op: ent.OpCreate},
+		})
+		_, ok = cs.Load(NewTypeKey("Upsert"))
+		assert.True(t, ok, "the id can not be determined")
+	})
+	t.Run("invalidateType", func(t *testing.T) {
+		id := 1
+		mutate(DataChangeNotify(WithDriverName("hook"), WithInvalidateType()), &idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Whole", op: ent.OpDeleteOne}, id: &id,
+		})
+		_, ok := cs.Load("Whole:1")
+		assert.False(t, ok)
+		_, ok = cs.Load(NewTypeKey("Whole"))
+		assert.True(t, ok)
+	})
+	t.Run("tags", func(t *testing.T) {
+		drv := driverManager["hook"]
+		assert.NoError(t, drv.Cache.Set(ctx, "tagged", 1))
+		assert.NoError(t, drv.tags.add(ctx, "tagged", []string{"catalog"}, time.Minute))
+		id := 1
+		mutate(DataChangeNotify(WithDriverName("hook"), WithMutationTags(func(ctx context.Context, m ent.Mutation) []string {
+			return []string{"catalog"}
+		})), &idMutation[int]{fakeMutation: fakeMutation{typ: "Tag", op: ent.OpCreate}, id: &id})
+		assert.False(t, drv.Cache.Has(ctx, "tagged"))
+	})
+	t.Run("create", func(t *testing.T) {
+		id := 1
+		mutate(DataChangeNotify(WithDriverName("hook")), &idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Create", op: ent.OpCreate}, id: &id,
+		})
+		_, ok := cs.Load("Create:1")
+		assert.False(t, ok)
+	})
+	t.Run("fields", func(t *testing.T) {
+		id := 1
+		hook := DataChangeNotify(WithDriverName("hook"))
+		mutate(hook, &idMutation[int]{fakeMutation: fakeMutation{typ: "Noop", op: ent.OpUpdateOne,
+			fields: map[string]ent.Value{"name": "a"}, old: map[string]ent.Value{"name": "a"}}, id: &id})
+		_, ok := cs.Load(NewTableKey("noops"))
+		assert.False(t, ok, "no-op update")
+
+		mutate(hook, &idMutation[int]{fakeMutation: fakeMutation{typ: "Field", op: ent.OpUpdateOne,
+			fields: map[string]ent.Value{"name": "a", "age": 2}, old: map[string]ent.Value{"name": "a", "age": 1}}, id: &id})
+		_, ok = cs.Load(NewFieldKey("Field", "1", "age"))
+		assert.True(t, ok)
+		_, ok = cs.Load(NewFieldKey("Field", "1", "name"))
+		assert.False(t, ok, "unchanged")
+		_, ok = cs.Load(NewEntryKey("Field", "1"))
+		assert.False(t, ok)
+
+		// the inner hook sets the field after the old values are read.
+		_, err := hook(ent.MutateFunc(func(_ context.Context, m ent.Mutation) (ent.Value, error) {
+			m.(*idMutation[int]).fields["updated_at"] = 2
+			return nil, nil
+		})).Mutate(ctx, &idMutation[int]{fakeMutation: fakeMutation{typ: "Inner", op: ent.OpUpdateOne,
+			fields: map[string]ent.Value{"name": "a"}, old: map[string]ent.Value{"name": "a", "updated_at": 1}}, id: &id})
+		assert.NoError(t, err)
+		_, ok = cs.Load(NewFieldKey("Inner", "1", "updated_at"))
+		assert.True(t, ok, "set by the inner hook")
+		_, ok = cs.Load(NewFieldKey("Inner", "1", "name"))
+		assert.False(t, ok)
+
+		RegisterColumn("Storage", "name", "full_name")
+		mutate(hook, &idMutation[int]{fakeMutation: fakeMutation{typ: "Storage", op: ent.OpUpdateOne,
+			fields: map[string]ent.Value{"name": "b"}}, id: &id})
+		_, ok = cs.Load(NewFieldKey("Storage", "1", "full_name"))
+		assert.True(t, ok, "recorded by the column of the StorageKey")
+		_, ok = cs.Load(NewFieldKey("Storage", "1", "name"))
+		assert.False(t, ok)
+
+		mutate(hook, &idMutation[int]{fakeMutation: fakeMutation{typ: "Unmapped", op: ent.OpUpdateOne,
+			fields: map[string]ent.Value{"name": "b"}}, id: &id})
+		_, ok = cs.Load(NewEntryKey("Unmapped", "1"))
+		assert.True(t, ok, "the column of the field is unknown")
+
+		mutate(hook, &idMutation[int]{fakeMutation: fakeMutation{typ: "Edge", op: ent.OpUpdateOne,
+			edges: []string{"owner"}}, id: &id})
+		_, ok = cs.Load(NewEntryKey("Edge", "1"))
+		assert.True(t, ok, "the foreign key changed")
+	})
+	t.Run("subscribe", func(t *testing.T) {
+		sctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		events := cs.Subscribe(sctx, ChangeFilter{Types: []string{"Event"}})
+		id := 1
+		mutate(DataChangeNotify(WithDriverName("hook")), &idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Event", op: ent.OpCreate}, id: &id,
+		})
+		mutate(DataChangeNotify(WithDriverName("hook")), &idMutation[int]{fakeMutation: fakeMutation{typ: "Event",
+			op: ent.OpUpdateOne, fields: map[string]ent.Value{"age": 2}}, id: &id})
+		mutate(DataChangeNotify(WithDriverName("hook")), &idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Event", op: ent.OpDelete}, ids: []int{1, 2},
+		})
+		e := <-events
+		assert.Equal(t, ent.OpCreate, e.Op)
+		assert.Equal(t, []string{"1"}, e.IDs, "the id of the create")
+		e = <-events
+		assert.Equal(t, ent.OpUpdateOne, e.Op)
+		assert.Equal(t, []string{"age"}, e.Fields)
+		e = <-events
+		assert.Equal(t, ent.OpDelete, e.Op)
+		assert.Equal(t, []string{"1", "2"}, e.IDs)
+	})
+	t.Run("error", func(t *testing.T) {
+		mutate(DataChangeNotify(WithDriverName("hook")), &idMutation[int]{
+			fakeMutation: fakeMutation{typ: "Error", op: ent.OpUpdate, fields: name}, err: errors.New("ids"),
+		})
+		_, ok := cs.Load(NewTypeKey("Error"))
+		assert.True(t, ok)
+	})
+}
@@ -0,0 +1,233 @@
+package entcache
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"entgo.io/ent"
+)
+
+// defaultEventBuffer is the default buffer size of a subscription.
+const defaultEventBuffer = 100
+
+// ChangeEvent is a change of the entities of a type, see ChangeSet.Subscribe.
+type ChangeEvent struct {
+	// Type is the entity type.
+	Type string
+	// IDs are the ids of the changed entities, empty if the whole type may have changed.
+	IDs []string
+	// Fields are the changed fields of an update, empty if the whole entity changed or the fields are unknown.
+	Fields []string
+	// Op is the operation of the change, 0 if it is unknown, such as the changes received from the other
+	// instances by the Transport or from the change sources, which fill in the Type, IDs, Fields and Time only.
+	Op ent.Op
+	// Time is when the change was published.
+	Time time.Time
+}
+
+// ChangeFilter selects the change events of a subscription.
+type ChangeFilter struct {
+	// Types are the entity types subscribed, empty means all types.
+	Types []string
+	// Op is the operations subscribed, such as ent.OpCreate|ent.OpUpdateOne, 0 means all. The events of the
+	// unknown operation match any filter.
+	Op ent.Op
+}
+
+// match reports whether the event is selected by the filter.
+func (f ChangeFilter) match(e ChangeEvent) bool {
+	if f.Op != 0 && e.Op != 0 && !e.Op.Is(f.Op) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, typ := range f.Types {
+		if typ == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// DropPolicy decides which event is dropped when the buffer of a subscription is full.
+type DropPolicy int
+
+const (
+	// DropNewest drops the event being published, the subscriber receives the earlier events.
+	DropNewest DropPolicy = iota
+	// DropOldest drops the oldest event in the buffer, the subscriber receives the latest events.
+	DropOldest
+)
+
+type subscribeOptions struct {
+	buffer int
+	policy DropPolicy
+}
+
+// SubscribeOption configures a subscription of the change events.
+type SubscribeOption func(*subscribeOptions)
+
+// WithEventBuffer sets the buffer size of the subscription, default is 100.
+func WithEventBuffer(size int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.buffer = size
+	}
+}
+
+// WithDropPolicy sets which event is dropped when the buffer is full, default is DropNewest. The publisher never
+// blocks on a slow subscriber.
+func WithDropPolicy(policy DropPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.policy = policy
+	}
+}
+
+// changeFeed fans the change events out to the subscriptions.
+type changeFeed struct {
+	mu   sync.RWMutex
+	subs map[*subscription]struct{}
+}
+
+type subscription struct {
+	filter ChangeFilter
+	policy DropPolicy
+
+	mu     sync.Mutex
+	ch     chan ChangeEvent
+	closed bool
+}
+
+// subscribe registers a subscription, which is removed and its channel closed when the context is done.
+func (f *changeFeed) subscribe(ctx context.Context, filter ChangeFilter, opts ...SubscribeOption) <-chan ChangeEvent {
+	o := subscribeOptions{buffer: defaultEventBuffer}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.buffer <= 0 {
+		o.buffer = defaultEventBuffer
+	}
+	s := &subscription{filter: filter, policy: o.policy, ch: make(chan ChangeEvent, o.buffer)}
+	f.mu.Lock()
+	if f.subs == nil {
+		f.subs = make(map[*subscription]struct{})
+	}
+	f.subs[s] = struct{}{}
+	f.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		f.mu.Lock()
+		delete(f.subs, s)
+		f.mu.Unlock()
+		s.close()
+	}()
+	return s.ch
+}
+
+// publish sends the events to the matched subscriptions.
+func (f *changeFeed) publish(events ...ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	now := time.Now()
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for s := range f.subs {
+		for _, e := range events {
+			if e.Time.IsZero() {
+				e.Time = now
+			}
+			if s.filter.match(e) {
+				s.send(e)
+			}
+		}
+	}
+}
+
+func (s *subscription) send(e ChangeEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- e:
+		return
+	default:
+	}
+	if s.policy == DropOldest {
+		select {
+		case <-s.ch:
+		default:
+		}
+		select {
+		case s.ch <- e:
+		default:
+		}
+	}
+}
+
+func (s *subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	close(s.ch)
+}
+
+// keyEvents returns the change events of the changed keys, one per type, the operations are unknown. The table
+// keys are skipped, since they are recorded along with the keys of the entities.
+func keyEvents(keys []Key) []ChangeEvent {
+	var (
+		events []ChangeEvent
+		index  = make(map[string]int)
+		// whole holds the types changed as a whole, entire holds the types of which some entities changed
+		// as a whole, their fields are dropped.
+		whole  = make(map[string]bool)
+		entire = make(map[string]bool)
+	)
+	for _, key := range keys {
+		if strings.HasPrefix(string(key), "table:") {
+			continue
+		}
+		typ, id, _ := strings.Cut(string(key), ":")
+		i, ok := index[typ]
+		if !ok {
+			i = len(events)
+			index[typ] = i
+			events = append(events, ChangeEvent{Type: typ})
+		}
+		if id == "*" {
+			whole[typ] = true
+			continue
+		}
+		id, field, isField := strings.Cut(id, "#")
+		e := &events[i]
+		if !contains(e.IDs, id) {
+			e.IDs = append(e.IDs, id)
+		}
+		switch {
+		case !isField:
+			entire[typ] = true
+		case field != "" && !contains(e.Fields, field):
+			e.Fields = append(e.Fields, field)
+		}
+	}
+	for typ := range entire {
+		events[index[typ]].Fields = nil
+	}
+	for typ := range whole {
+		events[index[typ]].IDs, events[index[typ]].Fields = nil, nil
+	}
+	return events
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
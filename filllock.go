@@ -0,0 +1,120 @@
+package entcache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tsingsun/woocoo/pkg/cache"
+)
+
+const (
+	// fillLockPrefix is the prefix of the redis keys holding the fill locks, after the CachePrefix.
+	fillLockPrefix = "entcache:lock:"
+	// defaultFillLockWait is the default time waiting for the fill of another instance.
+	defaultFillLockWait = 500 * time.Millisecond
+	// fillLockPollInterval is the interval of polling the cache while waiting for the fill.
+	fillLockPollInterval = 20 * time.Millisecond
+)
+
+// releaseFillLockScript deletes the lock only if it is still held by the token, an expired lock may be acquired
+// by another instance.
+var releaseFillLockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+
+// fillLock is a lease around the cache fills shared by all instances, see Config.FillLockTTL.
+type fillLock struct {
+	client redis.Cmdable
+	// prefix is the CachePrefix, the lock keys are under it.
+	prefix string
+	ttl    time.Duration
+	wait   time.Duration
+}
+
+// newFillLock returns the fillLock of a redis cache, or nil if the cache is not redis or the ttl is not set. A
+// local cache is filled by one instance, the queries in process are coalesced by Config.SingleFlight.
+func newFillLock(c cache.Cache, prefix string, ttl, wait time.Duration) *fillLock {
+	rc, ok := c.(interface{ RedisClient() redis.Cmdable })
+	if !ok || ttl <= 0 {
+		return nil
+	}
+	if wait <= 0 {
+		wait = defaultFillLockWait
+	}
+	return &fillLock{client: rc.RedisClient(), prefix: prefix, ttl: ttl, wait: wait}
+}
+
+func (l *fillLock) key(key Key) string {
+	return l.prefix + fillLockPrefix + strings.TrimPrefix(string(key), l.prefix)
+}
+
+// acquire tries to lock the fill of the key, it returns the token of the lock, or empty if the lock is held by
+// another one.
+func (l *fillLock) acquire(ctx context.Context, key Key) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	ok, err := l.client.SetNX(ctx, l.key(key), token, l.ttl).Result()
+	if err != nil || !ok {
+		return "", err
+	}
+	return token, nil
+}
+
+// release unlocks the fill of the key held by the token.
+func (l *fillLock) release(ctx context.Context, key Key, token string) error {
+	return releaseFillLockScript.Run(ctx, l.client, []string{l.key(key)}, token).Err()
+}
+
+// lockFill takes the fill lock of the key. If the lock is held by another instance, it polls the cache for the
+// entry filled by the holder until the wait budget is spent, and takes the lock if it is released without the
+// entry, such as the holder failed. It returns the entry, or the token if the caller holds the lock and fills the
+// entry, or neither after the deadline, then the caller queries the database without the lock.
+func (d *Driver) lockFill(ctx context.Context, opts ctxOptions) (*Entry, string, error) {
+	t := time.NewTicker(fillLockPollInterval)
+	defer t.Stop()
+	deadline := time.NewTimer(d.fillLock.wait)
+	defer deadline.Stop()
+	for {
+		token, err := d.fillLock.acquire(ctx, opts.key)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("entcache: failed acquiring fill lock of %v: %v", opts.key, err))
+			return nil, "", nil
+		}
+		if token != "" {
+			return nil, token, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		case <-deadline.C:
+			return nil, "", nil
+		case <-t.C:
+		}
+		var e Entry
+		err = d.Cache.Get(ctx, string(opts.key), &e, cache.WithSkip(opts.skipMode))
+		if err == nil {
+			return &e, "", nil
+		}
+		if !errors.Is(err, cache.ErrCacheMiss) {
+			return nil, "", nil
+		}
+	}
+}
+
+// releaseFill releases the fill lock of the key, the lock expires anyway.
+func (d *Driver) releaseFill(key Key, token string) {
+	if err := d.fillLock.release(context.Background(), key, token); err != nil {
+		logger.Warn(fmt.Sprintf("entcache: failed releasing fill lock of %v: %v", key, err))
+	}
+}
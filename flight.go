@@ -0,0 +1,86 @@
+package entcache
+
+import (
+	"context"
+	"sync"
+)
+
+// flight is an in-flight query of a cache key, see Config.SingleFlight.
+type flight struct {
+	done chan struct{}
+	once sync.Once
+	// entry is the result of the leader, nil if it failed.
+	entry *Entry
+}
+
+func (f *flight) finish(e *Entry) {
+	f.once.Do(func() {
+		f.entry = e
+		close(f.done)
+	})
+}
+
+// flightGroup coalesces the concurrent queries of the same cache key.
+type flightGroup struct {
+	mu sync.Mutex
+	m  map[Key]*flight
+}
+
+// join returns the flight of the key, leader reports whether the caller started it and should run the query.
+func (g *flightGroup) join(key Key) (f *flight, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.m[key]; ok {
+		return f, false
+	}
+	if g.m == nil {
+		g.m = make(map[Key]*flight)
+	}
+	f = &flight{done: make(chan struct{})}
+	g.m[key] = f
+	return f, true
+}
+
+// leave removes the flight of the key and finishes it with the entry, nil if the leader failed.
+func (g *flightGroup) leave(key Key, f *flight, e *Entry) {
+	g.mu.Lock()
+	if g.m[key] == f {
+		delete(g.m, key)
+	}
+	g.mu.Unlock()
+	f.finish(e)
+}
+
+// wait waits for the flight, it returns the entry of the leader, or nil if the leader failed.
+func (f *flight) wait(ctx context.Context) (*Entry, error) {
+	select {
+	case <-f.done:
+		return f.entry, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// flightScanner is the recorder of the leader, the followers get the recorded entry when it is closed. The entry
+// is shared only if all rows are read without error and the context of the leader is not done, since the rows
+// of a query closed early or canceled may be partial, and the lease of the leader is not revoked, since the
+// followers may start after the invalidation.
+type flightScanner struct {
+	*recorder
+	ctx   context.Context
+	fresh func() bool
+	leave func(*Entry)
+	// stop stops releasing the followers on the cancellation of the leader.
+	stop func() bool
+}
+
+func (s *flightScanner) Close() error {
+	s.stop()
+	err := s.recorder.Close()
+	if err == nil && s.recorder.done && s.recorder.ColumnScanner.Err() == nil && s.ctx.Err() == nil && s.fresh() {
+		s.leave(&Entry{Columns: s.recorder.columns, Values: s.recorder.values})
+	} else {
+		s.leave(nil)
+	}
+	return err
+}
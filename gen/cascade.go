@@ -0,0 +1,62 @@
+package gen
+
+import (
+	"entgo.io/ent/dialect/sql/schema"
+	"entgo.io/ent/entc/gen"
+)
+
+// cascade is a foreign key referencing the type, the rows of the table are changed by the database when an
+// entity of the type is deleted.
+type cascade struct {
+	// Type is the referenced entity type.
+	Type string
+	// Dependent is the entity type of the table, empty for the join table of a M2M edge.
+	Dependent string
+	// Table is the table holding the foreign key.
+	Table string
+	// OnDelete is the referential action of the foreign key.
+	OnDelete string
+}
+
+// cascades returns the foreign keys of the graph, resolved the same as the ent migration.
+func cascades(g *gen.Graph) []cascade {
+	var cs []cascade
+	for _, n := range g.Nodes {
+		for _, e := range n.Edges {
+			if e.IsInverse() {
+				continue
+			}
+			switch e.Rel.Type {
+			case gen.O2O, gen.O2M:
+				// the foreign key is on the table of the edge type, it is not nullable if the inverse edge is required.
+				nullable := n == e.Type || e.Ref == nil || e.Ref.Optional
+				cs = append(cs, cascade{Type: n.Name, Dependent: e.Type.Name, Table: e.Rel.Table, OnDelete: onDelete(e, nullable)})
+			case gen.M2O:
+				nullable := n == e.Type || e.Optional
+				cs = append(cs, cascade{Type: e.Type.Name, Dependent: n.Name, Table: e.Rel.Table, OnDelete: onDelete(e, nullable)})
+			case gen.M2M:
+				// the edge schema is a node, its foreign keys are resolved by its own edges.
+				if e.Through != nil || e.Ref != nil && e.Ref.Through != nil {
+					continue
+				}
+				cs = append(cs,
+					cascade{Type: n.Name, Table: e.Rel.Table, OnDelete: string(schema.Cascade)},
+					cascade{Type: e.Type.Name, Table: e.Rel.Table, OnDelete: string(schema.Cascade)},
+				)
+			}
+		}
+	}
+	return cs
+}
+
+// onDelete returns the referential action for DELETE operations of the edge.
+func onDelete(e *gen.Edge, nullable bool) string {
+	action := schema.NoAction
+	if nullable {
+		action = schema.SetNull
+	}
+	if ant := e.EntSQL(); ant != nil && ant.OnDelete != "" {
+		action = schema.ReferenceOption(ant.OnDelete)
+	}
+	return string(action)
+}
@@ -4,6 +4,7 @@ import (
 	"embed"
 	"entgo.io/ent/entc"
 	"entgo.io/ent/entc/gen"
+	"text/template"
 )
 
 var (
@@ -11,11 +12,15 @@ var (
 	_templates embed.FS
 )
 
-// QueryCache returns an entc.Option that generates the cached Get. It overrides the default client.tmpl
+// QueryCache returns an entc.Option that generates the cached Get. It overrides the default client.tmpl,
+// and generates entcache.go which registers the tables, the edges and the foreign keys of the schemas to entcache.
 func QueryCache() entc.Option {
 	return func(c *gen.Config) error {
 		c.Templates = append(c.Templates, gen.MustParse(gen.NewTemplate("client").
 			ParseFS(_templates, "template/client.tmpl")))
+		c.Templates = append(c.Templates, gen.MustParse(gen.NewTemplate("entcache").
+			Funcs(template.FuncMap{"cascades": cascades}).
+			ParseFS(_templates, "template/entcache.tmpl")))
 		c.Annotations.Set("EntCache", true)
 		return nil
 	}
@@ -0,0 +1,122 @@
+package entcache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tsingsun/woocoo/pkg/cache"
+)
+
+// generationPrefix is the prefix of the redis keys holding the generations, after the CachePrefix.
+const generationPrefix = "entcache:gen:"
+
+var (
+	// loadGenerationScript returns the generation, a missing one is initialized by the current time, so that
+	// a lost counter never returns to a previous generation.
+	loadGenerationScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if not v then
+	v = ARGV[1]
+	redis.call('SET', KEYS[1], v)
+end
+return v`)
+	// bumpGenerationScript increases the generation, it is initialized the same as loadGenerationScript.
+	bumpGenerationScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return redis.call('INCR', KEYS[1])`)
+)
+
+// generations holds the generation counters of the tables, see Config.KeyGeneration.
+type generations interface {
+	// load returns the generations of the tables.
+	load(ctx context.Context, tables []string) ([]int64, error)
+	// bump increases the generation of the table.
+	bump(ctx context.Context, table string) error
+	// shared reports whether the generations are shared by all instances.
+	shared() bool
+}
+
+// newGenerations returns the generations of the cache: redis counters for a redis cache, or counters in process
+// memory otherwise, since a local cache may evict the counters.
+func newGenerations(c cache.Cache, prefix string) generations {
+	if rc, ok := c.(interface{ RedisClient() redis.Cmdable }); ok {
+		return &redisGenerations{client: rc.RedisClient(), prefix: prefix + generationPrefix}
+	}
+	return &memoryGenerations{}
+}
+
+// withGenerations mixes the generations into the key.
+func withGenerations(key Key, gens []int64) Key {
+	if len(gens) == 0 {
+		return key
+	}
+	var b strings.Builder
+	b.WriteString(string(key))
+	for i, g := range gens {
+		if i == 0 {
+			b.WriteByte('@')
+		} else {
+			b.WriteByte('.')
+		}
+		b.WriteString(strconv.FormatInt(g, 10))
+	}
+	return Key(b.String())
+}
+
+// memoryGenerations are the generations in process memory.
+type memoryGenerations struct {
+	counters sync.Map
+}
+
+func (m *memoryGenerations) load(_ context.Context, tables []string) ([]int64, error) {
+	gens := make([]int64, len(tables))
+	for i, table := range tables {
+		if v, ok := m.counters.Load(table); ok {
+			gens[i] = v.(*atomic.Int64).Load()
+		}
+	}
+	return gens, nil
+}
+
+func (m *memoryGenerations) bump(_ context.Context, table string) error {
+	v, _ := m.counters.LoadOrStore(table, new(atomic.Int64))
+	v.(*atomic.Int64).Add(1)
+	return nil
+}
+
+func (m *memoryGenerations) shared() bool {
+	return false
+}
+
+// redisGenerations are the generations kept in redis, shared by all instances.
+type redisGenerations struct {
+	client redis.Cmdable
+	prefix string
+}
+
+func (r *redisGenerations) load(ctx context.Context, tables []string) ([]int64, error) {
+	gens := make([]int64, len(tables))
+	for i, table := range tables {
+		g, err := loadGenerationScript.Run(ctx, r.client, []string{r.prefix + table}, time.Now().UnixNano()).Int64()
+		if err != nil {
+			return nil, err
+		}
+		gens[i] = g
+	}
+	return gens, nil
+}
+
+func (r *redisGenerations) bump(ctx context.Context, table string) error {
+	return bumpGenerationScript.Run(ctx, r.client, []string{r.prefix + table}, time.Now().UnixNano()).Err()
+}
+
+func (r *redisGenerations) shared() bool {
+	return true
+}
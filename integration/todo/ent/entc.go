@@ -30,7 +30,7 @@ func main() {
 		entc.Extensions(ex),
 		cachegen.QueryCache(),
 		//entc.TemplateDir("./ent/template"),
-		entc.FeatureNames("intercept", "schema/snapshot"),
+		entc.FeatureNames("intercept", "schema/snapshot", "sql/upsert"),
 	}
 	if err := entc.Generate("./ent/schema", &gen.Config{}, opts...); err != nil {
 		log.Fatalf("running ent codegen: %v", err)
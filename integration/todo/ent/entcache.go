@@ -0,0 +1,29 @@
+// Code generated by ent, DO NOT EDIT.
+
+package ent
+
+import "github.com/woocoos/entcache"
+
+// init registers the schema graph to entcache, which is used to resolve the tables, the columns, the upserts, the
+// composite ids, the edges and the foreign keys of the mutations in DataChangeNotify, and the tables watched by the
+// outbox.
+func init() {
+	entcache.RegisterTable("Todo", "todos")
+	entcache.RegisterOutboxTable("todos", "id")
+	entcache.RegisterColumn("Todo", "text", "text")
+	entcache.RegisterColumn("Todo", "created_at", "created_at")
+	entcache.RegisterColumn("Todo", "status", "status")
+	entcache.RegisterColumn("Todo", "priority", "priority")
+	entcache.RegisterUpsert("Todo")
+	entcache.RegisterEdge("Todo", "parent", "Todo")
+	entcache.RegisterEdge("Todo", "children", "Todo")
+	entcache.RegisterEdge("Todo", "owner", "User")
+	entcache.RegisterTable("User", "users")
+	entcache.RegisterOutboxTable("users", "id")
+	entcache.RegisterColumn("User", "name", "name")
+	entcache.RegisterColumn("User", "age", "age")
+	entcache.RegisterUpsert("User")
+	entcache.RegisterEdge("User", "todos", "Todo")
+	entcache.RegisterCascade("Todo", "Todo", "todos", "SET NULL")
+	entcache.RegisterCascade("User", "Todo", "todos", "SET NULL")
+}
@@ -6,4 +6,4 @@
 // Package internal holds a loadable version of the latest schema.
 package internal
 
-const Schema = `{"Schema":"github.com/woocoos/entcache/integration/todo/ent/schema","Package":"github.com/woocoos/entcache/integration/todo/ent","Schemas":[{"name":"Todo","config":{"Table":""},"edges":[{"name":"parent","type":"Todo","ref":{"name":"children","type":"Todo"},"unique":true,"inverse":true},{"name":"owner","type":"User","ref_name":"todos","unique":true,"inverse":true}],"fields":[{"name":"text","type":{"Type":7,"Ident":"","PkgPath":"","PkgName":"","Nillable":false,"RType":null},"size":2147483647,"validators":1,"position":{"Index":0,"MixedIn":false,"MixinIndex":0},"annotations":{"EntGQL":{"OrderField":"TEXT"}}},{"name":"created_at","type":{"Type":2,"Ident":"","PkgPath":"time","PkgName":"","Nillable":false,"RType":null},"default":true,"default_kind":19,"immutable":true,"position":{"Index":1,"MixedIn":false,"MixinIndex":0},"annotations":{"EntGQL":{"OrderField":"CREATED_AT"}}},{"name":"status","type":{"Type":6,"Ident":"todo.Status","PkgPath":"","PkgName":"","Nillable":false,"RType":null},"enums":[{"N":"InProgress","V":"IN_PROGRESS"},{"N":"Completed","V":"COMPLETED"}],"default":true,"default_value":"IN_PROGRESS","default_kind":24,"position":{"Index":2,"MixedIn":false,"MixinIndex":0},"annotations":{"EntGQL":{"OrderField":"STATUS"}}},{"name":"priority","type":{"Type":12,"Ident":"","PkgPath":"","PkgName":"","Nillable":false,"RType":null},"default":true,"default_value":0,"default_kind":2,"position":{"Index":3,"MixedIn":false,"MixinIndex":0},"annotations":{"EntGQL":{"OrderField":"PRIORITY"}}}],"annotations":{"EntGQL":{"MutationInputs":[{"IsCreate":true},{}],"QueryField":{},"RelayConnection":true}}},{"name":"User","config":{"Table":""},"edges":[{"name":"todos","type":"Todo"}],"fields":[{"name":"name","type":{"Type":7,"Ident":"","PkgPath":"","PkgName":"","Nillable":false,"RType":null},"position":{"Index":0,"MixedIn":false,"MixinIndex":0}},{"name":"age","type":{"Type":20,"Ident":"","PkgPath":"","PkgName":"","Nillable":false,"RType":null},"optional":true,"position":{"Index":1,"MixedIn":false,"MixinIndex":0}}],"hooks":[{"Index":0,"MixedIn":false,"MixinIndex":0},{"Index":1,"MixedIn":false,"MixinIndex":0}],"interceptors":[{"Index":0,"MixedIn":false,"MixinIndex":0},{"Index":1,"MixedIn":false,"MixinIndex":0}],"annotations":{"EntGQL":{"MutationInputs":[{"IsCreate":true},{}],"QueryField":{},"RelayConnection":true},"EntSQL":{"table":"users"}}}],"Features":["namedges","intercept","schema/snapshot"]}`
+const Schema = `{"Schema":"github.com/woocoos/entcache/integration/todo/ent/schema","Package":"github.com/woocoos/entcache/integration/todo/ent","Schemas":[{"name":"Todo","config":{"Table":""},"edges":[{"name":"parent","type":"Todo","ref":{"name":"children","type":"Todo"},"unique":true,"inverse":true},{"name":"owner","type":"User","ref_name":"todos","unique":true,"inverse":true}],"fields":[{"name":"text","type":{"Type":7,"Ident":"","PkgPath":"","PkgName":"","Nillable":false,"RType":null},"size":2147483647,"validators":1,"position":{"Index":0,"MixedIn":false,"MixinIndex":0},"annotations":{"EntGQL":{"OrderField":"TEXT"}}},{"name":"created_at","type":{"Type":2,"Ident":"","PkgPath":"time","PkgName":"","Nillable":false,"RType":null},"default":true,"default_kind":19,"immutable":true,"position":{"Index":1,"MixedIn":false,"MixinIndex":0},"annotations":{"EntGQL":{"OrderField":"CREATED_AT"}}},{"name":"status","type":{"Type":6,"Ident":"todo.Status","PkgPath":"","PkgName":"","Nillable":false,"RType":null},"enums":[{"N":"InProgress","V":"IN_PROGRESS"},{"N":"Completed","V":"COMPLETED"}],"default":true,"default_value":"IN_PROGRESS","default_kind":24,"position":{"Index":2,"MixedIn":false,"MixinIndex":0},"annotations":{"EntGQL":{"OrderField":"STATUS"}}},{"name":"priority","type":{"Type":12,"Ident":"","PkgPath":"","PkgName":"","Nillable":false,"RType":null},"default":true,"default_value":0,"default_kind":2,"position":{"Index":3,"MixedIn":false,"MixinIndex":0},"annotations":{"EntGQL":{"OrderField":"PRIORITY"}}}],"annotations":{"EntGQL":{"MutationInputs":[{"IsCreate":true},{}],"QueryField":{},"RelayConnection":true}}},{"name":"User","config":{"Table":""},"edges":[{"name":"todos","type":"Todo"}],"fields":[{"name":"name","type":{"Type":7,"Ident":"","PkgPath":"","PkgName":"","Nillable":false,"RType":null},"position":{"Index":0,"MixedIn":false,"MixinIndex":0}},{"name":"age","type":{"Type":20,"Ident":"","PkgPath":"","PkgName":"","Nillable":false,"RType":null},"optional":true,"position":{"Index":1,"MixedIn":false,"MixinIndex":0}}],"hooks":[{"Index":0,"MixedIn":false,"MixinIndex":0},{"Index":1,"MixedIn":false,"MixinIndex":0}],"interceptors":[{"Index":0,"MixedIn":false,"MixinIndex":0},{"Index":1,"MixedIn":false,"MixinIndex":0}],"annotations":{"EntGQL":{"MutationInputs":[{"IsCreate":true},{}],"QueryField":{},"RelayConnection":true},"EntSQL":{"table":"users"}}}],"Features":["namedges","intercept","schema/snapshot","sql/upsert"]}`
@@ -26,7 +26,7 @@ func main() {
 	opts := []entc.Option{
 		entc.Extensions(ex),
 		cachegen.QueryCache(),
-		entc.FeatureNames("intercept", "schema/snapshot"),
+		entc.FeatureNames("intercept", "schema/snapshot", "sql/upsert"),
 	}
 	if err := entc.Generate("./todo/ent/schema", &gen.Config{}, opts...); err != nil {
 		log.Fatalf("running ent codegen: %v", err)
@@ -16,6 +16,7 @@ import (
 	"github.com/woocoos/entcache/integration/todo/ent/migrate"
 	"github.com/woocoos/entcache/integration/todo/ent/todo"
 	"github.com/woocoos/entcache/integration/todo/ent/user"
+	"strconv"
 	"testing"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -148,3 +149,108 @@ func (s *Suite) Test_DeleteUser() {
 	u, _ := s.ent.User.Get(ctx, us[0].ID)
 	s.ent.User.DeleteOneID(u.ID).ExecX(ctx)
 }
+
+func (s *Suite) TestHashQueryInvalidated() {
+	ctx := context.Background()
+	count := s.ent.User.Query().CountX(ctx)
+	s.Equal(count, s.ent.User.Query().CountX(ctx))
+	s.ent.User.Create().SetName("hash").SaveX(ctx)
+	s.Equal(count+1, s.ent.User.Query().CountX(ctx), "create should evict the queries on users")
+}
+
+func (s *Suite) TestTxCommit() {
+	ctx := context.Background()
+	u := s.ent.User.Create().SetName("tx").SaveX(ctx)
+	key := entcache.NewFieldKey("User", strconv.Itoa(u.ID), "")
+	s.Equal("tx", s.ent.User.GetX(ctx, u.ID).Name)
+
+	tx, err := s.ent.Tx(ctx)
+	s.Require().NoError(err)
+	tx.User.UpdateOneID(u.ID).SetName("tx1").ExecX(ctx)
+	_, ok := s.cacheDriver.ChangeSet.Load(key)
+	s.False(ok, "the change is not stored before commit")
+	s.Require().NoError(tx.Commit())
+	committed, ok := s.cacheDriver.ChangeSet.Load(key)
+	s.True(ok)
+	s.Equal("tx1", s.ent.User.GetX(ctx, u.ID).Name)
+
+	tx, err = s.ent.Tx(ctx)
+	s.Require().NoError(err)
+	tx.User.UpdateOneID(u.ID).SetName("tx2").ExecX(ctx)
+	s.Require().NoError(tx.Rollback())
+	t, _ := s.cacheDriver.ChangeSet.Load(key)
+	s.Equal(committed, t, "the change is dropped on rollback")
+	s.Equal("tx1", s.ent.User.GetX(ctx, u.ID).Name)
+
+	tx, err = s.ent.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	s.Require().NoError(err)
+	s.Equal("tx1", tx.User.GetX(ctx, u.ID).Name)
+	s.Require().NoError(tx.Commit())
+}
+
+func (s *Suite) TestEdgeChanged() {
+	ctx := context.Background()
+	target, ok := entcache.EdgeType("User", "todos")
+	s.Require().True(ok, "registered by the generated code")
+	s.Equal("Todo", target)
+
+	td := s.ent.Todo.Create().SetText("edge").SaveX(ctx)
+	u := s.ent.User.Create().SetName("edge").SaveX(ctx)
+	key := entcache.NewEntryKey("Todo", strconv.Itoa(td.ID))
+	s.Nil(s.ent.Todo.GetX(ctx, td.ID).QueryOwner().FirstX(ctx))
+
+	u.Update().AddTodos(td).ExecX(ctx)
+	_, ok = s.cacheDriver.ChangeSet.Load(key)
+	s.True(ok)
+	s.Equal(u.ID, s.ent.Todo.GetX(ctx, td.ID).QueryOwner().OnlyIDX(ctx))
+
+	u.Update().RemoveTodos(td).ExecX(ctx)
+	s.Zero(s.ent.Todo.GetX(ctx, td.ID).QueryOwner().CountX(ctx))
+
+	u.Update().ClearTodos().ExecX(ctx)
+	_, ok = s.cacheDriver.ChangeSet.Load(entcache.NewTypeKey("Todo"))
+	s.True(ok, "the ids of a cleared edge are unknown")
+}
+
+func (s *Suite) TestBulkUpdatePredicate() {
+	ctx := context.Background()
+	u := s.ent.User.Create().SetName("bulk").SaveX(ctx)
+	s.Equal("bulk", s.ent.User.GetX(ctx, u.ID).Name)
+	// the update changes the field of the predicate.
+	s.ent.User.Update().Where(user.Name("bulk")).SetName("bulk1").ExecX(ctx)
+	_, ok := s.cacheDriver.ChangeSet.Load(entcache.NewFieldKey("User", strconv.Itoa(u.ID), "name"))
+	s.True(ok)
+	s.Equal("bulk1", s.ent.User.GetX(ctx, u.ID).Name)
+}
+
+func (s *Suite) TestFieldChanged() {
+	ctx := context.Background()
+	u := s.ent.User.Create().SetName("field").SetAge(1).SaveX(ctx)
+	s.Equal("field", s.ent.User.GetX(ctx, u.ID).Name)
+	key := entcache.NewFieldKey("User", strconv.Itoa(u.ID), "")
+
+	u.Update().SetName("field").ExecX(ctx)
+	_, ok := s.cacheDriver.ChangeSet.Load(key)
+	s.False(ok, "no-op update")
+
+	u.Update().SetName("field").SetAge(2).ExecX(ctx)
+	_, ok = s.cacheDriver.ChangeSet.Load(key)
+	s.True(ok)
+	_, ok = s.cacheDriver.ChangeSet.Load(entcache.NewFieldKey("User", strconv.Itoa(u.ID), "name"))
+	s.False(ok)
+	s.Equal(2.0, s.ent.User.GetX(ctx, u.ID).Age)
+}
+
+func (s *Suite) TestDeleteCascade() {
+	ctx := context.Background()
+	u := s.ent.User.Create().SetName("cascade").SaveX(ctx)
+	td := s.ent.Todo.Create().SetText("cascade").SetOwner(u).SaveX(ctx)
+	s.ent.Todo.Create().SetText("child").SetParent(td).ExecX(ctx)
+	s.cacheDriver.ChangeSet.Delete(entcache.NewTypeKey("Todo"))
+
+	s.ent.User.DeleteOne(u).ExecX(ctx)
+	_, ok := s.cacheDriver.ChangeSet.Load(entcache.NewTypeKey("Todo"))
+	s.True(ok, "the owner of the todos is set null by the database")
+	_, ok = s.cacheDriver.ChangeSet.Load(entcache.NewTableKey("todos"))
+	s.True(ok)
+}
@@ -0,0 +1,157 @@
+package entcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// flushBatchSize is the count of keys scanned and deleted at a time when flushing a redis cache.
+const flushBatchSize = 1000
+
+// Invalidation reports what an explicit invalidation removed.
+type Invalidation struct {
+	// Keys are the change keys stored to the ChangeSet, the entries depending on them are evicted on their
+	// next query.
+	Keys []Key
+	// Removed is the count of the cache entries removed at once.
+	Removed int
+	// All reports whether the whole cache is cleaned, such as a local cache which can not list its keys,
+	// the Removed is unknown then.
+	All bool
+}
+
+// Invalidate marks the entities of the type changed, such as the rows modified out of the driver. The entries
+// cached by the ids and the queries referencing them are evicted on their next query.
+func (d *Driver) Invalidate(ctx context.Context, typ string, ids ...any) (Invalidation, error) {
+	if typ == "" {
+		return Invalidation{}, errors.New("entcache: invalidate with empty type")
+	}
+	if len(ids) == 0 {
+		return Invalidation{}, nil
+	}
+	keys := make([]Key, 0, len(ids)+1)
+	event := ChangeEvent{Type: typ, IDs: make([]string, 0, len(ids))}
+	for _, id := range ids {
+		sid := fmt.Sprint(id)
+		event.IDs = append(event.IDs, sid)
+		keys = append(keys, NewEntryKey(typ, sid))
+	}
+	keys = append(keys, NewTableKey(TableName(typ)))
+	d.storeMutationChanges(ctx, keys...)
+	d.publishChanges(ctx, event)
+	return Invalidation{Keys: keys}, nil
+}
+
+// InvalidateType marks all entities of the type changed, every entry reading the type is evicted on its
+// next query.
+func (d *Driver) InvalidateType(ctx context.Context, typ string) (Invalidation, error) {
+	if typ == "" {
+		return Invalidation{}, errors.New("entcache: invalidate with empty type")
+	}
+	keys := []Key{NewTypeKey(typ), NewTableKey(TableName(typ))}
+	d.storeMutationChanges(ctx, keys...)
+	d.publishChanges(ctx, ChangeEvent{Type: typ})
+	return Invalidation{Keys: keys}, nil
+}
+
+// InvalidateQuery removes the entry cached by the query and args at once, the key is computed by CacheKey.
+func (d *Driver) InvalidateQuery(ctx context.Context, query string, args []any) (Invalidation, error) {
+	key, err := d.CacheKey(ctx, query, args)
+	if err != nil {
+		return Invalidation{}, err
+	}
+	k := string(key)
+	if !d.Cache.Has(ctx, k) {
+		return Invalidation{}, nil
+	}
+	if err = d.Cache.Del(ctx, k); err != nil {
+		return Invalidation{}, err
+	}
+	return Invalidation{Removed: 1}, nil
+}
+
+// InvalidateTags removes the entries of the tags at once, see WithTags. The mapping of the tags is kept in the
+// redis sets with a redis cache, or in process memory otherwise.
+func (d *Driver) InvalidateTags(ctx context.Context, tags ...string) (Invalidation, error) {
+	if len(tags) == 0 {
+		return Invalidation{}, nil
+	}
+	for _, tag := range tags {
+		d.leases.revoke(tagLease(tag))
+	}
+	n, err := d.tags.invalidate(ctx, tags)
+	return Invalidation{Removed: n}, err
+}
+
+// invalidateTags invalidates the tags of the mutations, the failure is logged.
+func (d *Driver) invalidateTags(tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	if _, err := d.InvalidateTags(context.Background(), tags...); err != nil {
+		logger.Warn(fmt.Sprintf("entcache: failed invalidating tags %v: %v", tags, err))
+	}
+}
+
+// invalidateMutationTags invalidates the tags of a mutation. If the mutation is executed in a transaction of
+// the driver, the tags are buffered until the transaction commits.
+func (d *Driver) invalidateMutationTags(ctx context.Context, tags ...string) {
+	if s := mutationFromContext(ctx); s != nil && s.tx != nil {
+		s.tx.storeTags(tags...)
+		return
+	}
+	d.invalidateTags(tags)
+}
+
+// Flush removes all entries of the driver from the cache at once.
+//
+// A redis cache is shared, its keys under CachePrefix are scanned and deleted, so CachePrefix is required.
+// Note that with a redis cluster only the keys of the node which the scan runs on are deleted. A local cache
+// such as TinyLFU is owned by the driver and cleaned as a whole. Other caches are not supported.
+func (d *Driver) Flush(ctx context.Context) (Invalidation, error) {
+	d.leases.revokeAll()
+	switch c := d.Cache.(type) {
+	case interface{ RedisClient() redis.Cmdable }:
+		if d.CachePrefix == "" {
+			return Invalidation{}, errors.New("entcache: flush a redis cache requires the CachePrefix")
+		}
+		n, err := flushRedis(ctx, c.RedisClient(), d.CachePrefix+"*")
+		if lc, ok := c.(interface{ CleanLocalCache() }); ok {
+			lc.CleanLocalCache()
+		}
+		return Invalidation{Removed: n}, err
+	case interface{ Clean() }:
+		c.Clean()
+		return Invalidation{All: true}, nil
+	default:
+		return Invalidation{}, fmt.Errorf("entcache: flush is not supported by cache %T", d.Cache)
+	}
+}
+
+// flushRedis deletes the keys matching the pattern in batches and returns the count of the deleted keys.
+func flushRedis(ctx context.Context, client redis.Cmdable, pattern string) (int, error) {
+	var (
+		cursor uint64
+		count  int
+	)
+	for {
+		keys, next, err := client.Scan(ctx, cursor, pattern, flushBatchSize).Result()
+		if err != nil {
+			return count, err
+		}
+		if len(keys) > 0 {
+			n, err := client.Del(ctx, keys...).Result()
+			count += int(n)
+			if err != nil {
+				return count, err
+			}
+		}
+		if next == 0 {
+			return count, nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,117 @@
+package entcache
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// leaseSlots is the number of the version counters of the leases, a power of 2.
+const leaseSlots = 1024
+
+// leases guard the deferred cache fills against the invalidations racing with them, like the leases of memcache.
+//
+// A query missing the cache takes a lease of the tables and the tags it reads before it queries the database,
+// an invalidation revokes the leases of its tables and tags. If the lease is revoked when the rows are recorded,
+// they may be read before the change committed, so they are not stored, the next query fills the entry.
+//
+// The leases are versioned by the striped counters, so the memory is bounded, a collision only skips a fill.
+//
+// The leases are local to the process. With a cache shared by instances, the changes of other instances revoke
+// them only when received by the Transport of a MemoryChangeSet, a CacheChangeSet does not revoke them. So the
+// race between a fill and an invalidation on another instance is not covered, the delayed evictions such as
+// Config.TxEvictDelay and the TTL bound the stale entry then.
+type leases struct {
+	// epoch revokes all leases, such as on Flush.
+	epoch    atomic.Uint64
+	versions [leaseSlots]atomic.Uint64
+}
+
+// lease is a snapshot of the versions of the leased names.
+type lease struct {
+	epoch    uint64
+	slots    []uint32
+	versions []uint64
+}
+
+// leaseSlot returns the counter slot of the name by its FNV-1a hash.
+func leaseSlot(name string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return h & (leaseSlots - 1)
+}
+
+// acquire takes the lease of the names, see queryLeases.
+func (l *leases) acquire(names []string) lease {
+	ls := lease{
+		epoch:    l.epoch.Load(),
+		slots:    make([]uint32, len(names)),
+		versions: make([]uint64, len(names)),
+	}
+	for i, name := range names {
+		ls.slots[i] = leaseSlot(name)
+		ls.versions[i] = l.versions[ls.slots[i]].Load()
+	}
+	return ls
+}
+
+// valid reports whether the lease is not revoked since it was acquired.
+func (l *leases) valid(ls lease) bool {
+	if l.epoch.Load() != ls.epoch {
+		return false
+	}
+	for i, slot := range ls.slots {
+		if l.versions[slot].Load() != ls.versions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// revoke revokes the leases of the names.
+func (l *leases) revoke(names ...string) {
+	for _, name := range names {
+		l.versions[leaseSlot(name)].Add(1)
+	}
+}
+
+// revokeAll revokes all leases.
+func (l *leases) revokeAll() {
+	l.epoch.Add(1)
+}
+
+// queryLeases returns the lease names of a query, that are its tables and tags.
+func queryLeases(query string, tags []string) []string {
+	tables := queryTables(query)
+	names := make([]string, 0, len(tables)+len(tags))
+	for _, table := range tables {
+		names = append(names, string(NewTableKey(table)))
+	}
+	for _, tag := range tags {
+		names = append(names, tagLease(tag))
+	}
+	return names
+}
+
+// changeLeases returns the lease names revoked by the changed keys, that are the tables of them.
+func changeLeases(keys []Key) []string {
+	names := make([]string, 0, len(keys))
+	seen := make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		name := string(key)
+		if !strings.HasPrefix(name, "table:") {
+			name = string(NewTableKey(TableName(entryType(key))))
+		}
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func tagLease(tag string) string {
+	return "tag:" + tag
+}
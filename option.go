@@ -14,7 +14,9 @@ type (
 		// Name of the driver, used for ent cache driver mandger.
 		Name string `yaml:"name" json:"name"`
 		// Cache defines the cache implementation for holding the cache entries.
-		// Default is tinyLFU with size 100000 and HashQueryTTL 1 minute.
+		// Default is tinyLFU with size 100000 and HashQueryTTL 1 minute. The leases guarding the fills against the
+		// racing invalidations are local to the process, so with a cache shared by instances they cover the
+		// invalidations of other instances only if received by a Transport.
 		Cache cache.Cache `yaml:"-" json:"-"`
 		// HashQueryTTL defines the period of time that an Entry that is hashed through by not Get
 		// is valid in the cache.
@@ -28,8 +30,34 @@ type (
 		StoreKey string `yaml:"storeKey" json:"storeKey"`
 		// CachePrefix is the prefix of cache key, avoid key conflict in redis cache
 		CachePrefix string `yaml:"cachePrefix" json:"cachePrefix"`
-		// ChangeSet manages data change
-		ChangeSet *ChangeSet
+		// TxEvictDelay defines the delay after a transaction committed to store its changed keys again, that evicts
+		// the stale entries cached by the queries racing with the commit. Default is 1 second, 0 disables it.
+		TxEvictDelay time.Duration `yaml:"txEvictDelay" json:"txEvictDelay"`
+		// KeyGeneration enables the generation counter of each table, it is mixed into the keys of the entries
+		// reading the table. When the whole type is marked changed, the generation of its table is bumped, that
+		// orphans all entries of the table at once without scanning keys. The counters are kept in redis with a
+		// redis cache, that costs a round trip per table for each query, or in process memory otherwise.
+		KeyGeneration bool `yaml:"keyGeneration" json:"keyGeneration"`
+		// SingleFlight coalesces the concurrent identical queries missing the cache in process, keyed by the cache
+		// key: one of them runs the query and the others replay its result. The evicting queries and the queries
+		// in a transaction are not coalesced.
+		SingleFlight bool `yaml:"singleFlight" json:"singleFlight"`
+		// FillLockTTL enables the fill lock shared by all instances with a redis cache, it is the TTL of the lock
+		// taken by SET NX before the query missing the cache fills it, 0 disables it. The others missing the same
+		// key poll the cache for the entry, and query the database after FillLockWait. It should be longer than
+		// the slowest query, the lock expires if the holder crashed.
+		FillLockTTL time.Duration `yaml:"fillLockTTL" json:"fillLockTTL"`
+		// FillLockWait is the max time waiting for the fill of the lock holder, default is 500 milliseconds.
+		FillLockWait time.Duration `yaml:"fillLockWait" json:"fillLockWait"`
+		// SoftTTL enables the stale-while-revalidate mode, an entry older than SoftTTL is still served until its
+		// TTL, the hard TTL, expires, and refreshed in background. 0 disables it, it is also set per query by
+		// WithSoftTTL. It applies only if it is shorter than the TTL of the entry.
+		SoftTTL time.Duration `yaml:"softTTL" json:"softTTL"`
+		// RefreshConcurrency is the max number of the entries refreshed in background at once, default is 4. The
+		// refreshes beyond it are skipped, the next stale hit tries again.
+		RefreshConcurrency int `yaml:"refreshConcurrency" json:"refreshConcurrency"`
+		// ChangeSet manages data change, default is a MemoryChangeSet with GCInterval.
+		ChangeSet ChangeSet
 	}
 
 	// Option allows configuring the cache
@@ -37,7 +65,8 @@ type (
 	Option func(*Config)
 )
 
-func WithChangeSet(cs *ChangeSet) Option {
+// WithChangeSet provides a ChangeSet implementation for managing the data change.
+func WithChangeSet(cs ChangeSet) Option {
 	return func(c *Config) {
 		c.ChangeSet = cs
 	}
@@ -0,0 +1,329 @@
+package entcache
+
+import (
+	"context"
+	stdsql "database/sql"
+	"database/sql/driver"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"time"
+
+	"entgo.io/ent/dialect"
+	"entgo.io/ent/dialect/sql"
+)
+
+const (
+	defaultOutboxTable   = "entcache_outbox"
+	defaultPollInterval  = time.Second
+	defaultPollBatchSize = 1000
+	// maxTriggerName is the max length of the trigger names, which is the identifier limit of MySQL.
+	maxTriggerName = 64
+)
+
+var (
+	_ ChangeSource = (*OutboxSource)(nil)
+
+	// outboxTables holds the tables registered by RegisterOutboxTable in order.
+	outboxTables   []OutboxTable
+	outboxTablesMu sync.RWMutex
+)
+
+// OutboxTable is a table whose changes are written to the outbox by the triggers.
+type OutboxTable struct {
+	// Name is the table name.
+	Name string
+	// ID is the primary key column, empty for the tables without a single column primary key, such as the join
+	// tables, then the changes invalidate the whole table.
+	ID string
+}
+
+// RegisterOutboxTable registers a table watched by the outbox triggers, see OutboxDDL. The registrations are
+// generated by the gen package from the schema graph, include the join tables of the M2M edges.
+func RegisterOutboxTable(table, id string) {
+	outboxTablesMu.Lock()
+	defer outboxTablesMu.Unlock()
+	for i, t := range outboxTables {
+		if t.Name == table {
+			outboxTables[i].ID = id
+			return
+		}
+	}
+	outboxTables = append(outboxTables, OutboxTable{Name: table, ID: id})
+}
+
+// OutboxTables returns the registered outbox tables.
+func OutboxTables() []OutboxTable {
+	outboxTablesMu.RLock()
+	defer outboxTablesMu.RUnlock()
+	return append([]OutboxTable(nil), outboxTables...)
+}
+
+// OutboxDDL returns the statements creating the outbox table and the triggers writing the changed rows of the
+// tables into it, as (table, pk, changed_at). The dialect is one of sqlite3, mysql and postgres, the outbox is
+// the name of the outbox table, default is "entcache_outbox". The statements are idempotent, the existing
+// triggers are replaced.
+//
+//	stmts, err := entcache.OutboxDDL(dialect.MySQL, "", entcache.OutboxTables()...)
+func OutboxDDL(dialectName, outbox string, tables ...OutboxTable) ([]string, error) {
+	if outbox == "" {
+		outbox = defaultOutboxTable
+	}
+	switch dialectName {
+	case dialect.SQLite:
+		return sqliteOutboxDDL(outbox, tables), nil
+	case dialect.MySQL:
+		return mysqlOutboxDDL(outbox, tables), nil
+	case dialect.Postgres:
+		return postgresOutboxDDL(outbox, tables), nil
+	default:
+		return nil, fmt.Errorf("entcache: outbox is not supported by dialect %q", dialectName)
+	}
+}
+
+// triggerEvents are the trigger events and the row holding the primary key.
+var triggerEvents = []struct{ event, row string }{
+	{"INSERT", "NEW"},
+	{"UPDATE", "NEW"},
+	{"DELETE", "OLD"},
+}
+
+func sqliteOutboxDDL(outbox string, tables []OutboxTable) []string {
+	q := func(s string) string { return `"` + s + `"` }
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (%s integer PRIMARY KEY AUTOINCREMENT, %s text NOT NULL, %s text NULL, %s datetime NOT NULL DEFAULT CURRENT_TIMESTAMP)`,
+			q(outbox), q("id"), q("table_name"), q("pk"), q("changed_at")),
+	}
+	for _, t := range tables {
+		for _, e := range triggerEvents {
+			name := q(triggerName(outbox, t.Name, e.event))
+			stmts = append(stmts,
+				"DROP TRIGGER IF EXISTS "+name,
+				fmt.Sprintf("CREATE TRIGGER %s AFTER %s ON %s BEGIN INSERT INTO %s (%s, %s) VALUES (%s, %s); END",
+					name, e.event, q(t.Name), q(outbox), q("table_name"), q("pk"), literal(t.Name), pkValue(t, e.row, q)),
+			)
+		}
+	}
+	return stmts
+}
+
+func mysqlOutboxDDL(outbox string, tables []OutboxTable) []string {
+	q := func(s string) string { return "`" + s + "`" }
+	stmts := []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s bigint NOT NULL AUTO_INCREMENT PRIMARY KEY, %s varchar(255) NOT NULL, %s varchar(255) NULL, %s timestamp(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6))",
+			q(outbox), q("id"), q("table_name"), q("pk"), q("changed_at")),
+	}
+	for _, t := range tables {
+		for _, e := range triggerEvents {
+			name := q(triggerName(outbox, t.Name, e.event))
+			stmts = append(stmts,
+				"DROP TRIGGER IF EXISTS "+name,
+				fmt.Sprintf("CREATE TRIGGER %s AFTER %s ON %s FOR EACH ROW INSERT INTO %s (%s, %s) VALUES (%s, %s)",
+					name, e.event, q(t.Name), q(outbox), q("table_name"), q("pk"), literal(t.Name), pkValue(t, e.row, q)),
+			)
+		}
+	}
+	return stmts
+}
+
+// postgresOutboxDDL uses one trigger function for all tables, the primary key column is passed as the
+// trigger argument.
+func postgresOutboxDDL(outbox string, tables []OutboxTable) []string {
+	q := func(s string) string { return `"` + s + `"` }
+	fn := q(outbox + "_notify")
+	stmts := []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (%s bigserial PRIMARY KEY, %s varchar(255) NOT NULL, %s varchar(255) NULL, %s timestamptz NOT NULL DEFAULT now())`,
+			q(outbox), q("id"), q("table_name"), q("pk"), q("changed_at")),
+		fmt.Sprintf(`CREATE OR REPLACE FUNCTION %s() RETURNS trigger AS $$
+DECLARE r record;
+BEGIN
+	IF TG_OP = 'DELETE' THEN r := OLD; ELSE r := NEW; END IF;
+	INSERT INTO %s (%s, %s) VALUES (TG_TABLE_NAME, CASE WHEN TG_NARGS > 0 THEN to_jsonb(r)->>TG_ARGV[0] END);
+	RETURN NULL;
+END $$ LANGUAGE plpgsql`, fn, q(outbox), q("table_name"), q("pk")),
+	}
+	for _, t := range tables {
+		var arg string
+		if t.ID != "" {
+			arg = literal(t.ID)
+		}
+		stmts = append(stmts,
+			fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s", q(outbox), q(t.Name)),
+			fmt.Sprintf("CREATE TRIGGER %s AFTER INSERT OR UPDATE OR DELETE ON %s FOR EACH ROW EXECUTE FUNCTION %s(%s)",
+				q(outbox), q(t.Name), fn, arg),
+		)
+	}
+	return stmts
+}
+
+// triggerName returns the name of the trigger of the table and event. A name longer than maxTriggerName is
+// truncated with the FNV-1a hash of the full name as the suffix, so that it is still unique.
+func triggerName(outbox, table, event string) string {
+	name := outbox + "_" + table + "_" + strings.ToLower(event)
+	if len(name) <= maxTriggerName {
+		return name
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	suffix := fmt.Sprintf("_%08x", h.Sum32())
+	return name[:maxTriggerName-len(suffix)] + suffix
+}
+
+// literal returns the string literal of s.
+func literal(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// pkValue returns the primary key expression of the row in the trigger.
+func pkValue(t OutboxTable, row string, quote func(string) string) string {
+	if t.ID == "" {
+		return "NULL"
+	}
+	return row + "." + quote(t.ID)
+}
+
+// OutboxSource is a ChangeSource polling the outbox table, which is written by the triggers created by OutboxDDL.
+// So the writes made out of the Driver, by the batch jobs, the services in other languages or DBA fixes, are
+// invalidated as well.
+//
+// A changed row marks its entity and table changed, a row without the primary key marks the table and the whole
+// type changed. The polled rows are deleted, so with several instances polling the same outbox, a change is
+// consumed by one of them, use a Transport or a shared ChangeSet to propagate it.
+type OutboxSource struct {
+	drv      dialect.Driver
+	table    string
+	interval time.Duration
+	batch    int
+}
+
+// OutboxOption configures the OutboxSource.
+type OutboxOption func(*OutboxSource)
+
+// WithOutboxTable sets the name of the outbox table, default is "entcache_outbox".
+func WithOutboxTable(table string) OutboxOption {
+	return func(s *OutboxSource) {
+		s.table = table
+	}
+}
+
+// WithPollInterval sets the interval of polling the outbox, default is 1 second.
+func WithPollInterval(interval time.Duration) OutboxOption {
+	return func(s *OutboxSource) {
+		s.interval = interval
+	}
+}
+
+// WithPollBatchSize sets the max number of the outbox rows read at a time, default is 1000.
+func WithPollBatchSize(size int) OutboxOption {
+	return func(s *OutboxSource) {
+		s.batch = size
+	}
+}
+
+// NewOutboxSource creates an OutboxSource reading the outbox by drv, which should be the underlying driver
+// rather than the cached Driver.
+func NewOutboxSource(drv dialect.Driver, opts ...OutboxOption) *OutboxSource {
+	s := &OutboxSource{
+		drv:      drv,
+		table:    defaultOutboxTable,
+		interval: defaultPollInterval,
+		batch:    defaultPollBatchSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Watch implements the ChangeSource interface, it polls the outbox every interval.
+func (s *OutboxSource) Watch(ctx context.Context, fn func(keys ...Key)) error {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-t.C:
+			// a full batch indicates more rows in the outbox.
+			for {
+				n, err := s.poll(ctx, fn)
+				if err != nil {
+					return err
+				}
+				if n < s.batch {
+					break
+				}
+			}
+		}
+	}
+}
+
+// poll reads a batch of the outbox rows, calls fn with their keys and deletes them. It returns the number of
+// the rows read.
+func (s *OutboxSource) poll(ctx context.Context, fn func(keys ...Key)) (int, error) {
+	query, args := sql.Dialect(s.drv.Dialect()).
+		Select("id", "table_name", "pk").
+		From(sql.Table(s.table)).
+		OrderBy("id").
+		Limit(s.batch).
+		Query()
+	rows := &sql.Rows{}
+	if err := s.drv.Query(ctx, query, args, rows); err != nil {
+		return 0, err
+	}
+	var (
+		ids  []driver.Value
+		keys []Key
+		seen = make(map[Key]struct{})
+	)
+	add := func(key Key) {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	for rows.Next() {
+		var (
+			id    int64
+			table string
+			pk    stdsql.NullString
+		)
+		if err := rows.Scan(&id, &table, &pk); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+		add(NewTableKey(table))
+		switch typ, ok := types.Load(table); {
+		case pk.Valid:
+			add(NewEntryKey(TypeName(table), pk.String))
+		case ok:
+			add(NewTypeKey(typ.(string)))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return 0, err
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	fn(keys...)
+	query, args = sql.Dialect(s.drv.Dialect()).
+		Delete(s.table).
+		Where(sql.InValues("id", ids...)).
+		Query()
+	if err := s.drv.Exec(ctx, query, args, nil); err != nil {
+		return len(ids), err
+	}
+	return len(ids), nil
+}
+
+// Close implements the ChangeSource interface. The driver is owned by the caller and is not closed.
+func (s *OutboxSource) Close() error {
+	return nil
+}
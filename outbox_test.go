@@ -0,0 +1,136 @@
+package entcache
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"entgo.io/ent/dialect"
+	"entgo.io/ent/dialect/sql"
+	"github.com/stretchr/testify/suite"
+)
+
+type outboxSuite struct {
+	suite.Suite
+	DB *sql.Driver
+}
+
+func TestOutboxSuite(t *testing.T) {
+	suite.Run(t, new(outboxSuite))
+}
+
+func (t *outboxSuite) SetupSuite() {
+	db, err := sql.Open(dialect.SQLite, "file:outbox?mode=memory&cache=shared&_fk=1")
+	t.Require().NoError(err)
+	t.DB = db
+	ctx := context.Background()
+	t.Require().NoError(t.DB.Exec(ctx, "create table items (id integer primary key autoincrement, name text)", []any{}, nil))
+	t.Require().NoError(t.DB.Exec(ctx, "create table item_tags (item_id integer, tag text)", []any{}, nil))
+	RegisterTable("Item", "items")
+	stmts, err := OutboxDDL(dialect.SQLite, "", OutboxTable{Name: "items", ID: "id"}, OutboxTable{Name: "item_tags"})
+	t.Require().NoError(err)
+	for _, stmt := range stmts {
+		t.Require().NoError(t.DB.Exec(ctx, stmt, []any{}, nil), stmt)
+	}
+	// installing twice replaces the triggers.
+	for _, stmt := range stmts {
+		t.Require().NoError(t.DB.Exec(ctx, stmt, []any{}, nil), stmt)
+	}
+}
+
+func (t *outboxSuite) TearDownSuite() {
+	t.DB.Close()
+}
+
+func (t *outboxSuite) exec(query string, args ...any) {
+	t.Require().NoError(t.DB.Exec(context.Background(), query, args, nil))
+}
+
+func (t *outboxSuite) TestPoll() {
+	ctx := context.Background()
+	src := NewOutboxSource(t.DB, WithPollBatchSize(2))
+	t.exec("insert into items (id, name) values (?, ?)", 1, "a")
+	t.exec("update items set name = ? where id = ?", "b", 1)
+	t.exec("insert into item_tags values (?, ?)", 1, "x")
+	t.exec("delete from items where id = ?", 1)
+
+	var keys []Key
+	fn := func(ks ...Key) {
+		keys = append(keys, ks...)
+	}
+	n, err := src.poll(ctx, fn)
+	t.Require().NoError(err)
+	t.Equal(2, n, "bounded by the batch size")
+	t.Equal([]Key{"table:items", "Item:1"}, keys)
+
+	keys = nil
+	n, err = src.poll(ctx, fn)
+	t.Require().NoError(err)
+	t.Equal(2, n)
+	t.Equal([]Key{"table:item_tags", "table:items", "Item:1"}, keys, "the join table is only invalidated by table")
+
+	n, err = src.poll(ctx, fn)
+	t.Require().NoError(err)
+	t.Zero(n, "the polled rows are deleted")
+}
+
+func (t *outboxSuite) TestChangeSet() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := NewChangeSet(time.Minute, WithChangeSource(NewOutboxSource(t.DB, WithPollInterval(10*time.Millisecond))))
+	received := make(chan []Key, 10)
+	cs.onReceive(func(keys []Key, remote bool) {
+		if !remote {
+			received <- keys
+		}
+	})
+	go cs.Start(ctx) //nolint:errcheck
+	t.exec("insert into items (id, name) values (?, ?)", 2, "a")
+	t.Eventually(func() bool {
+		_, ok := cs.Load("Item:2")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	_, ok := cs.Load(NewTableKey("items"))
+	t.True(ok)
+	select {
+	case keys := <-received:
+		t.Contains(keys, Key("Item:2"), "notified to the driver")
+	case <-time.After(time.Second):
+		t.Fail("not notified")
+	}
+	t.NoError(cs.Stop(ctx))
+}
+
+func (t *outboxSuite) TestDDL() {
+	stmts, err := OutboxDDL(dialect.MySQL, "outbox", OutboxTable{Name: "users", ID: "id"})
+	t.Require().NoError(err)
+	t.Len(stmts, 7)
+	t.Contains(stmts[0], "CREATE TABLE IF NOT EXISTS `outbox`")
+	t.Equal("CREATE TRIGGER `outbox_users_delete` AFTER DELETE ON `users` FOR EACH ROW "+
+		"INSERT INTO `outbox` (`table_name`, `pk`) VALUES ('users', OLD.`id`)", stmts[6])
+
+	long := strings.Repeat("t", 60)
+	stmts, err = OutboxDDL(dialect.MySQL, "", OutboxTable{Name: long + "1"}, OutboxTable{Name: long + "2"})
+	t.Require().NoError(err)
+	names := make(map[string]struct{})
+	for _, stmt := range stmts[1:] {
+		if name, ok := strings.CutPrefix(stmt, "CREATE TRIGGER `"); ok {
+			name, _, _ = strings.Cut(name, "`")
+			t.LessOrEqual(len(name), maxTriggerName, name)
+			names[name] = struct{}{}
+		}
+	}
+	t.Len(names, 6, "the truncated names are unique")
+
+	stmts, err = OutboxDDL(dialect.Postgres, "", OutboxTable{Name: "users", ID: "id"}, OutboxTable{Name: "user_groups"})
+	t.Require().NoError(err)
+	t.Len(stmts, 6)
+	t.True(strings.HasPrefix(stmts[1], `CREATE OR REPLACE FUNCTION "entcache_outbox_notify"()`))
+	t.Equal(`CREATE TRIGGER "entcache_outbox" AFTER INSERT OR UPDATE OR DELETE ON "users" FOR EACH ROW `+
+		`EXECUTE FUNCTION "entcache_outbox_notify"('id')`, stmts[3])
+	t.True(strings.HasSuffix(stmts[5], `"entcache_outbox_notify"()`))
+
+	_, err = OutboxDDL("oracle", "")
+	t.Error(err)
+}
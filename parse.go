@@ -0,0 +1,443 @@
+package entcache
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// token is a lexical token of a sql statement.
+type token struct {
+	text string
+	// quoted reports whether the token is a quoted identifier, such as `users` or "users".
+	quoted bool
+}
+
+// is reports whether the token is the given keyword, case-insensitively.
+func (t token) is(keyword string) bool {
+	return !t.quoted && strings.EqualFold(t.text, keyword)
+}
+
+// ident reports whether the token can be an identifier.
+func (t token) ident() bool {
+	if t.quoted {
+		return true
+	}
+	r := rune(t.text[0])
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// tokenize splits the statement into tokens. String literals and comments are dropped, the placeholders
+// and punctuations are returned as single tokens.
+func tokenize(query string) []token {
+	var tokens []token
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return tokens
+			}
+			i += end + 4
+		case c == '\'':
+			// skip string literal, the escaped quote '' is treated as two literals.
+			end := strings.IndexByte(query[i+1:], '\'')
+			if end < 0 {
+				return tokens
+			}
+			tokens = append(tokens, token{text: "''"})
+			i += end + 2
+		case c == '`' || c == '"' || c == '[':
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			end := strings.IndexByte(query[i+1:], closing)
+			if end < 0 {
+				return tokens
+			}
+			tokens = append(tokens, token{text: query[i+1 : i+1+end], quoted: true})
+			i += end + 2
+		case c == '_' || c == '$' || c == '@' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c)):
+			j := i + 1
+			for j < len(query) && (query[j] == '_' || query[j] == '$' ||
+				unicode.IsLetter(rune(query[j])) || unicode.IsDigit(rune(query[j]))) {
+				j++
+			}
+			tokens = append(tokens, token{text: query[i:j]})
+			i = j
+		default:
+			tokens = append(tokens, token{text: query[i : i+1]})
+			i++
+		}
+	}
+	return tokens
+}
+
+// clauseKeywords are the keywords which can follow a table reference, they are not treated as an alias.
+var clauseKeywords = map[string]struct{}{
+	"WHERE": {}, "JOIN": {}, "INNER": {}, "LEFT": {}, "RIGHT": {}, "FULL": {}, "CROSS": {}, "OUTER": {},
+	"NATURAL": {}, "ON": {}, "USING": {}, "GROUP": {}, "ORDER": {}, "HAVING": {}, "LIMIT": {}, "OFFSET": {},
+	"UNION": {}, "EXCEPT": {}, "INTERSECT": {}, "FOR": {}, "WINDOW": {}, "SET": {}, "VALUES": {},
+	"RETURNING": {}, "SELECT": {}, "DEFAULT": {}, "AS": {},
+}
+
+func isClauseKeyword(t token) bool {
+	if t.quoted {
+		return false
+	}
+	_, ok := clauseKeywords[strings.ToUpper(t.text)]
+	return ok
+}
+
+// tableAt reads a possibly qualified table name at tokens[i], such as `db`.`users`. It returns the table name
+// without the qualifier and the index after it, or an empty name if there is no table reference at i.
+func tableAt(tokens []token, i int) (string, int) {
+	if i >= len(tokens) || !tokens[i].ident() || isClauseKeyword(tokens[i]) {
+		return "", i
+	}
+	name := tokens[i].text
+	i++
+	for i+1 < len(tokens) && tokens[i].text == "." && tokens[i+1].ident() {
+		name = tokens[i+1].text
+		i += 2
+	}
+	return name, i
+}
+
+// skipAlias skips the optional alias of a table reference at tokens[i].
+func skipAlias(tokens []token, i int) int {
+	if i < len(tokens) && tokens[i].is("AS") {
+		return i + 2
+	}
+	if i < len(tokens) && tokens[i].ident() && !isClauseKeyword(tokens[i]) {
+		return i + 1
+	}
+	return i
+}
+
+// queryTables returns the tables referenced by the FROM and JOIN clauses of a SELECT statement, including
+// the ones in the sub queries. The result is deduplicated and keeps the order of appearance.
+func queryTables(query string) []string {
+	var (
+		tables []string
+		seen   = make(map[string]struct{})
+		tokens = tokenize(query)
+	)
+	add := func(name string) {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			tables = append(tables, name)
+		}
+	}
+	for i := 0; i < len(tokens); i++ {
+		switch {
+		case tokens[i].is("JOIN"):
+			if name, _ := tableAt(tokens, i+1); name != "" {
+				add(name)
+			}
+		case tokens[i].is("FROM"):
+			// a FROM clause may list several tables: FROM a, b AS t.
+			for j := i + 1; ; {
+				name, next := tableAt(tokens, j)
+				if name == "" {
+					break
+				}
+				add(name)
+				next = skipAlias(tokens, next)
+				if next >= len(tokens) || tokens[next].text != "," {
+					break
+				}
+				j = next + 1
+			}
+		}
+	}
+	return tables
+}
+
+// queryIdents returns the identifiers in the query, such as the columns and the tables. The result is
+// deduplicated and keeps the order of appearance.
+func queryIdents(query string) []string {
+	var (
+		idents []string
+		seen   = make(map[string]struct{})
+	)
+	for _, t := range tokenize(query) {
+		if !t.ident() || isClauseKeyword(t) {
+			continue
+		}
+		if _, ok := seen[t.text]; !ok {
+			seen[t.text] = struct{}{}
+			idents = append(idents, t.text)
+		}
+	}
+	return idents
+}
+
+// selectsAll reports whether the query projects all columns by a star, such as SELECT * or SELECT `t`.*. The star
+// of COUNT(*) or a multiplication is not a projection.
+func selectsAll(query string) bool {
+	tokens := tokenize(query)
+	for i := 1; i < len(tokens); i++ {
+		if tokens[i].text != "*" || tokens[i].quoted {
+			continue
+		}
+		if prev := tokens[i-1]; prev.is("SELECT") || prev.is("DISTINCT") || prev.text == "," || prev.text == "." {
+			return true
+		}
+	}
+	return false
+}
+
+// limitQuery appends the LIMIT clause of n rows to the SELECT statement. The statement having a LIMIT clause, in
+// itself or in a sub query, is returned as is.
+func limitQuery(query string, n int) string {
+	for _, t := range tokenize(query) {
+		if t.is("LIMIT") {
+			return query
+		}
+	}
+	return query + " LIMIT " + strconv.Itoa(n)
+}
+
+// writeStatement is the parsed result of a data modification statement.
+type writeStatement struct {
+	// table is the target table.
+	table string
+	// insert reports whether the statement is an INSERT.
+	insert bool
+	// delete reports whether the statement is a DELETE.
+	delete bool
+	// upsert reports whether the insert statement may overwrite the existing rows,
+	// such as ON CONFLICT, ON DUPLICATE KEY and REPLACE.
+	upsert bool
+	// ids are the primary keys of the affected rows, nil if they can not be determined.
+	ids []string
+}
+
+// primaryKey is the primary key column name used to extract the affected ids.
+const primaryKey = "id"
+
+// parseWrite parses an INSERT, UPDATE or DELETE statement. It reports false if the statement is not
+// a data modification statement or the target table can not be found.
+//
+// The affected ids are extracted from the WHERE clause of UPDATE and DELETE, if it is a primary key
+// equality or IN list, and all other top-level conditions are ANDed.
+func parseWrite(query string, args []any) (stmt writeStatement, ok bool) {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return stmt, false
+	}
+	i := 1
+	switch {
+	case tokens[0].is("INSERT"), tokens[0].is("REPLACE"):
+		stmt.insert = true
+		stmt.upsert = tokens[0].is("REPLACE")
+		for ; i < len(tokens) && !tokens[i].is("INTO"); i++ {
+			// INSERT OR REPLACE INTO
+			if tokens[i].is("REPLACE") {
+				stmt.upsert = true
+			}
+		}
+		i++
+	case tokens[0].is("UPDATE"):
+		// skip the modifiers: UPDATE OR IGNORE, UPDATE LOW_PRIORITY IGNORE, UPDATE ONLY.
+		for i < len(tokens) && (tokens[i].is("OR") || tokens[i].is("IGNORE") || tokens[i].is("ROLLBACK") ||
+			tokens[i].is("ABORT") || tokens[i].is("FAIL") || tokens[i].is("REPLACE") ||
+			tokens[i].is("LOW_PRIORITY") || tokens[i].is("ONLY")) {
+			i++
+		}
+	case tokens[0].is("DELETE"):
+		stmt.delete = true
+		for ; i < len(tokens) && !tokens[i].is("FROM"); i++ {
+		}
+		i++
+		if i < len(tokens) && tokens[i].is("ONLY") {
+			i++
+		}
+	default:
+		return stmt, false
+	}
+	if stmt.table, i = tableAt(tokens, i); stmt.table == "" {
+		return stmt, false
+	}
+	if stmt.insert {
+		for j := i; j < len(tokens); j++ {
+			// ON CONFLICT and ON DUPLICATE KEY
+			if tokens[j].is("ON") && j+1 < len(tokens) && (tokens[j+1].is("CONFLICT") || tokens[j+1].is("DUPLICATE")) {
+				stmt.upsert = true
+			}
+		}
+		return stmt, true
+	}
+	stmt.ids = whereIDs(tokens, i, args)
+	return stmt, true
+}
+
+// whereIDs extracts the primary keys from the top-level WHERE clause after tokens[from].
+func whereIDs(tokens []token, from int, args []any) []string {
+	where, depth := -1, 0
+	for i := from; i < len(tokens); i++ {
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		default:
+			if depth == 0 && tokens[i].is("WHERE") {
+				where = i
+			}
+		}
+		if where >= 0 {
+			break
+		}
+	}
+	if where < 0 {
+		return nil
+	}
+	end := len(tokens)
+	for i := where + 1; i < len(tokens) && end == len(tokens); i++ {
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		default:
+			if depth == 0 && (tokens[i].is("RETURNING") || tokens[i].is("ORDER") || tokens[i].is("LIMIT")) {
+				end = i
+			}
+		}
+	}
+	return conditionIDs(tokens, where+1, end, args)
+}
+
+// conditionIDs extracts the primary keys from the condition in tokens[start:end].
+func conditionIDs(tokens []token, start, end int, args []any) []string {
+	// strip the enclosing parentheses.
+	for start < end && tokens[start].text == "(" && closingParen(tokens, start) == end-1 {
+		start, end = start+1, end-1
+	}
+	// split by the top-level AND, any top-level OR makes the ids undetermined.
+	for i, depth, from := start, 0, start; i <= end; i++ {
+		if i < end {
+			switch tokens[i].text {
+			case "(":
+				depth++
+				continue
+			case ")":
+				depth--
+				continue
+			}
+			if depth > 0 {
+				continue
+			}
+			if tokens[i].is("OR") {
+				return nil
+			}
+			if !tokens[i].is("AND") {
+				continue
+			}
+		}
+		var ids []string
+		if from < i && tokens[from].text == "(" && closingParen(tokens, from) == i-1 {
+			ids = conditionIDs(tokens, from, i, args)
+		} else {
+			ids = predicateIDs(tokens[from:i], tokens[:from], args)
+		}
+		if ids != nil {
+			return ids
+		}
+		from = i + 1
+	}
+	return nil
+}
+
+// predicateIDs extracts the primary keys from a single predicate such as `t`.`id` = ? or id IN (?, ?).
+// The preceding tokens are used to resolve the index of the positional placeholders.
+func predicateIDs(pred, preceding []token, args []any) []string {
+	if len(pred) < 3 {
+		return nil
+	}
+	col := 0
+	for col+2 < len(pred) && pred[col+1].text == "." {
+		col += 2
+	}
+	if !strings.EqualFold(pred[col].text, primaryKey) {
+		return nil
+	}
+	pos := countPlaceholders(preceding) + countPlaceholders(pred[:col+1])
+	switch rest := pred[col+1:]; {
+	case len(rest) == 2 && rest[0].text == "=":
+		if id, ok := argValue(rest[1], &pos, args); ok {
+			return []string{id}
+		}
+	case len(rest) > 3 && rest[0].is("IN") && rest[1].text == "(" && closingParen(rest, 1) == len(rest)-1:
+		var ids []string
+		for i := 2; i < len(rest)-1; i++ {
+			if rest[i].text == "," {
+				continue
+			}
+			id, ok := argValue(rest[i], &pos, args)
+			if !ok {
+				return nil
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	return nil
+}
+
+// argValue returns the value of a placeholder or numeric literal. pos is the index of the next
+// positional placeholder.
+func argValue(t token, pos *int, args []any) (string, bool) {
+	switch {
+	case t.text == "?":
+		i := *pos
+		*pos++
+		if i < len(args) {
+			return fmt.Sprint(args[i]), true
+		}
+	case strings.HasPrefix(t.text, "$"):
+		if i, err := strconv.Atoi(t.text[1:]); err == nil && i > 0 && i <= len(args) {
+			return fmt.Sprint(args[i-1]), true
+		}
+	case !t.quoted && t.text[0] >= '0' && t.text[0] <= '9':
+		return t.text, true
+	}
+	return "", false
+}
+
+func countPlaceholders(tokens []token) (n int) {
+	for _, t := range tokens {
+		if t.text == "?" {
+			n++
+		}
+	}
+	return
+}
+
+// closingParen returns the index of the parenthesis closing tokens[open], or -1.
+func closingParen(tokens []token, open int) int {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch tokens[i].text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
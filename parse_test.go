@@ -0,0 +1,175 @@
+package entcache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryTables(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+	}{
+		{
+			name:  "simple",
+			query: "SELECT age FROM users",
+			want:  []string{"users"},
+		},
+		{
+			name:  "quoted",
+			query: "SELECT `users`.`id`, `users`.`name` FROM `users` WHERE `users`.`id` = ?",
+			want:  []string{"users"},
+		},
+		{
+			name:  "qualified with alias",
+			query: `SELECT "t1"."id" FROM "public"."users" AS "t1" WHERE "t1"."name" = $1`,
+			want:  []string{"users"},
+		},
+		{
+			name:  "join and sub query",
+			query: "SELECT `todos`.`id` FROM `todos` JOIN (SELECT `user_todos` FROM `users` WHERE `id` = ?) AS `t1` ON `todos`.`user_todos` = `t1`.`user_todos`",
+			want:  []string{"todos", "users"},
+		},
+		{
+			name:  "from list",
+			query: "select * from users u, todos t where u.id = t.owner and t.text = 'from groups'",
+			want:  []string{"users", "todos"},
+		},
+		{
+			name:  "in sub query",
+			query: "SELECT COUNT(*) FROM `users` WHERE `users`.`id` IN (SELECT `todos`.`user_todos` FROM `todos`)",
+			want:  []string{"users", "todos"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, queryTables(tt.query))
+		})
+	}
+}
+
+func TestSelectsAll(t *testing.T) {
+	assert.True(t, selectsAll("SELECT * FROM users WHERE id = ?"))
+	assert.True(t, selectsAll("SELECT DISTINCT * FROM users"))
+	assert.True(t, selectsAll("SELECT `t1`.*, `t2`.`name` FROM `users` AS `t1` JOIN `todos` AS `t2`"))
+	assert.True(t, selectsAll("SELECT id, * FROM users"))
+	assert.False(t, selectsAll("SELECT COUNT(*) FROM users"))
+	assert.False(t, selectsAll("SELECT age * 2 FROM users"))
+	assert.False(t, selectsAll("SELECT `*` FROM users"))
+}
+
+func TestLimitQuery(t *testing.T) {
+	assert.Equal(t, "SELECT DISTINCT `users`.`id` FROM `users` WHERE `users`.`age` > ? LIMIT 3",
+		limitQuery("SELECT DISTINCT `users`.`id` FROM `users` WHERE `users`.`age` > ?", 3))
+	query := "SELECT `id` FROM `users` WHERE `id` IN (SELECT `owner_id` FROM `todos` LIMIT 10)"
+	assert.Equal(t, query, limitQuery(query, 3), "a LIMIT clause exists")
+	assert.Equal(t, "SELECT `id` FROM `users` WHERE `name` = 'limit' LIMIT 3",
+		limitQuery("SELECT `id` FROM `users` WHERE `name` = 'limit'", 3), "not a clause")
+}
+
+func TestTableName(t *testing.T) {
+	assert.Equal(t, "users", TableName("User"))
+	assert.Equal(t, "todo_items", TableName("TodoItem"))
+	RegisterTable("Category", "category")
+	assert.Equal(t, "category", TableName("Category"))
+	assert.Equal(t, "Category", TypeName("category"))
+	assert.Equal(t, "TodoItem", TypeName("todo_items"))
+}
+
+func TestCascadeChanges(t *testing.T) {
+	RegisterCascade("Org", "Team", "teams", "CASCADE")
+	RegisterCascade("Org", "", "org_tags", "CASCADE")
+	RegisterCascade("Team", "Member", "members", "SET NULL")
+	RegisterCascade("Team", "Team", "teams", "SET NULL")
+	RegisterCascade("Member", "Card", "cards", "NO ACTION")
+	assert.Equal(t, []Key{
+		NewTableKey("teams"), NewTypeKey("Team"), NewTableKey("org_tags"),
+		NewTableKey("members"), NewTypeKey("Member"),
+	}, cascadeChanges("Org"))
+	assert.Empty(t, cascadeChanges("Member"), "restricted")
+}
+
+func TestParseWrite(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		args  []any
+		want  writeStatement
+		ok    bool
+	}{
+		{
+			name:  "update one",
+			query: "UPDATE `users` SET `name` = ?, `age` = ? WHERE `id` = ?",
+			args:  []any{"a", 1, 10},
+			want:  writeStatement{table: "users", ids: []string{"10"}},
+			ok:    true,
+		},
+		{
+			name:  "update in",
+			query: `UPDATE "public"."users" SET "name" = $1 WHERE "users"."id" IN ($2, $3) AND "age" > $4`,
+			args:  []any{"a", 1, 2, 18},
+			want:  writeStatement{table: "users", ids: []string{"1", "2"}},
+			ok:    true,
+		},
+		{
+			name:  "delete and",
+			query: "DELETE FROM users WHERE age > ? AND (users.id = ?)",
+			args:  []any{18, 3},
+			want:  writeStatement{table: "users", delete: true, ids: []string{"3"}},
+			ok:    true,
+		},
+		{
+			name:  "delete or",
+			query: "DELETE FROM users WHERE id = ? OR age > ?",
+			args:  []any{3, 18},
+			want:  writeStatement{table: "users", delete: true},
+			ok:    true,
+		},
+		{
+			name:  "update sub query",
+			query: "UPDATE users SET age = 1 WHERE id IN (SELECT user_id FROM todos WHERE id = ?)",
+			args:  []any{3},
+			want:  writeStatement{table: "users"},
+			ok:    true,
+		},
+		{
+			name:  "insert",
+			query: "INSERT INTO `users` (`name`) VALUES (?) RETURNING `id`",
+			args:  []any{"a"},
+			want:  writeStatement{table: "users", insert: true},
+			ok:    true,
+		},
+		{
+			name:  "upsert",
+			query: "INSERT INTO `users` (`id`, `name`) VALUES (?, ?) ON CONFLICT (`id`) DO UPDATE SET `name` = `excluded`.`name`",
+			args:  []any{1, "a"},
+			want:  writeStatement{table: "users", insert: true, upsert: true},
+			ok:    true,
+		},
+		{
+			name:  "replace",
+			query: "INSERT OR REPLACE INTO users (id, name) VALUES (1, 'a')",
+			want:  writeStatement{table: "users", insert: true, upsert: true},
+			ok:    true,
+		},
+		{
+			name:  "select",
+			query: "SELECT * FROM users",
+		},
+		{
+			name:  "ddl",
+			query: "CREATE TABLE users (id integer)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseWrite(tt.query, tt.args)
+			assert.Equal(t, tt.ok, ok)
+			if ok {
+				assert.Equal(t, tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package entcache
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+
+	"entgo.io/ent/dialect/sql"
+)
+
+// defaultRefreshConcurrency is the default max number of the entries refreshed in background at once.
+const defaultRefreshConcurrency = 4
+
+// refresh queries the stale entry in background and stores it, see Config.SoftTTL. The context is detached from
+// the cancellation of the caller and keeps its values. The refreshes of the same key are deduplicated, and the
+// refresh is skipped if the concurrency is full.
+func (d *Driver) refresh(ctx context.Context, query string, args any, opts ctxOptions) {
+	if _, loaded := d.refreshing.LoadOrStore(opts.key, struct{}{}); loaded {
+		return
+	}
+	select {
+	case d.refreshSem <- struct{}{}:
+	default:
+		d.refreshing.Delete(opts.key)
+		return
+	}
+	go func() {
+		defer func() {
+			<-d.refreshSem
+			d.refreshing.Delete(opts.key)
+		}()
+		if err := d.refreshEntry(context.WithoutCancel(ctx), query, args, opts); err != nil {
+			logger.Warn(fmt.Sprintf("entcache: failed refreshing entry %v: %v", opts.key, err))
+		}
+	}()
+}
+
+// refreshEntry runs the query and stores all rows of it.
+func (d *Driver) refreshEntry(ctx context.Context, query string, args any, opts ctxOptions) error {
+	ls := d.leases.acquire(queryLeases(query, opts.tags))
+	rows := &sql.Rows{}
+	if err := d.Driver.Query(ctx, query, args, rows); err != nil {
+		return err
+	}
+	rec := &recorder{
+		ColumnScanner: rows.ColumnScanner,
+		onClose: func(columns []string, values [][]driver.Value) {
+			d.storeEntry(ctx, opts, ls, columns, values)
+		},
+	}
+	columns, err := rec.Columns()
+	if err != nil {
+		rec.ColumnScanner.Close()
+		return err
+	}
+	dest := make([]any, len(columns))
+	for i := range dest {
+		dest[i] = new(any)
+	}
+	for rec.Next() {
+		if err := rec.Scan(dest...); err != nil {
+			rec.ColumnScanner.Close()
+			return err
+		}
+	}
+	if err := rec.Err(); err != nil {
+		rec.ColumnScanner.Close()
+		return err
+	}
+	return rec.Close()
+}
@@ -0,0 +1,211 @@
+package entcache
+
+import (
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/go-openapi/inflect"
+)
+
+var (
+	// tables maps the entity type to its table name.
+	tables sync.Map
+	// types maps the table name to its entity type.
+	types sync.Map
+	// edges maps the entity type to its edges, which are the map from the edge name to the entity type
+	// on the other end.
+	edges sync.Map
+	// columns maps the entity type to its fields, which are the map from the field name to the column.
+	columns sync.Map
+	// compositeIDs maps the edge schema type to its id fields.
+	compositeIDs sync.Map
+	// upserts holds the entity types whose create builders support OnConflict.
+	upserts sync.Map
+	// cascades maps the entity type to the foreign keys referencing it.
+	cascades   = make(map[string][]cascade)
+	cascadesMu sync.RWMutex
+
+	rules = inflect.NewDefaultRuleset()
+)
+
+// cascade is a foreign key referencing an entity type.
+type cascade struct {
+	dependent string
+	table     string
+	onDelete  string
+}
+
+// RegisterTable registers the table name of the entity type. It is required if the table name of a schema is
+// customized and differs from the ent default.
+func RegisterTable(typ, table string) {
+	tables.Store(typ, table)
+	types.Store(table, typ)
+}
+
+// TableName returns the table name of the entity type. If the type is not registered, it returns the
+// ent default table name, that is the snake case plural form of the type.
+func TableName(typ string) string {
+	if v, ok := tables.Load(typ); ok {
+		return v.(string)
+	}
+	return snake(rules.Pluralize(typ))
+}
+
+// TypeName returns the entity type of the table. If the table is not registered, it returns the
+// camel case singular form of the table, the reverse of the ent default table name.
+func TypeName(table string) string {
+	if v, ok := types.Load(table); ok {
+		return v.(string)
+	}
+	return rules.Camelize(rules.Singularize(table))
+}
+
+// RegisterEdge registers the edge of the entity type and the entity type on the other end of it.
+// The registrations are generated by the gen package from the schema graph.
+func RegisterEdge(typ, edge, target string) {
+	v, _ := edges.LoadOrStore(typ, &sync.Map{})
+	v.(*sync.Map).Store(edge, target)
+}
+
+// EdgeType returns the entity type on the other end of the edge, or false if the edge is not registered.
+func EdgeType(typ, edge string) (string, bool) {
+	v, ok := edges.Load(typ)
+	if !ok {
+		return "", false
+	}
+	target, ok := v.(*sync.Map).Load(edge)
+	if !ok {
+		return "", false
+	}
+	return target.(string), true
+}
+
+// RegisterColumn registers the column of the field of the entity type, which differs from the field name if the
+// field has a custom StorageKey. The changed fields of the mutations are recorded by their columns, the fields not
+// registered mark the whole entity changed. The registrations are generated by the gen package from the schema
+// graph.
+func RegisterColumn(typ, field, column string) {
+	v, _ := columns.LoadOrStore(typ, &sync.Map{})
+	v.(*sync.Map).Store(field, column)
+}
+
+// fieldColumns returns the columns of the fields of the entity type, or false if any of them is not registered.
+func fieldColumns(typ string, fields []string) ([]string, bool) {
+	v, ok := columns.Load(typ)
+	if !ok {
+		return nil, false
+	}
+	cols := make([]string, len(fields))
+	for i, f := range fields {
+		c, ok := v.(*sync.Map).Load(f)
+		if !ok {
+			return nil, false
+		}
+		cols[i] = c.(string)
+	}
+	return cols, true
+}
+
+// RegisterCompositeID registers the id fields of an edge schema with a composite id, in the order of the
+// schema definition. The registrations are generated by the gen package from the schema graph.
+func RegisterCompositeID(typ string, fields ...string) {
+	compositeIDs.Store(typ, fields)
+}
+
+// compositeIDFields returns the id fields of the edge schema, or false if the type has no composite id.
+func compositeIDFields(typ string) ([]string, bool) {
+	v, ok := compositeIDs.Load(typ)
+	if !ok {
+		return nil, false
+	}
+	return v.([]string), true
+}
+
+// RegisterUpsert registers the entity type whose create builders support OnConflict, that is generated with
+// the sql/upsert feature. The creates of the type may overwrite the existing rows.
+func RegisterUpsert(typ string) {
+	upserts.Store(typ, struct{}{})
+}
+
+// upsertable reports whether the creates of the entity type may be upserts.
+func upsertable(typ string) bool {
+	_, ok := upserts.Load(typ)
+	return ok
+}
+
+// RegisterCascade registers a foreign key referencing the entity type, which is held by the table of the
+// dependent type, or by a join table if dependent is empty. onDelete is the referential action of the foreign key,
+// such as CASCADE and SET NULL. The registrations are generated by the gen package from the schema graph.
+func RegisterCascade(typ, dependent, table, onDelete string) {
+	cascadesMu.Lock()
+	defer cascadesMu.Unlock()
+	cascades[typ] = append(cascades[typ], cascade{dependent: dependent, table: table, onDelete: onDelete})
+}
+
+// cascadeChanges returns the keys changed by the database when the entities of the type are deleted: the tables
+// holding the foreign keys, and the dependent types since the ids of the changed rows are unknown. The CASCADE
+// actions are followed transitively.
+//
+// The ON UPDATE actions are not followed, since the ids of ent are immutable after creation and the ent migration
+// does not set the ON UPDATE actions. The dependents of an id changed by raw sql must be invalidated explicitly,
+// such as by Driver.InvalidateType.
+func cascadeChanges(typ string) []Key {
+	cascadesMu.RLock()
+	defer cascadesMu.RUnlock()
+	var (
+		keys    []Key
+		seen    = make(map[Key]struct{})
+		visited = map[string]struct{}{typ: {}}
+		queue   = []string{typ}
+	)
+	add := func(key Key) {
+		if _, ok := seen[key]; !ok {
+			seen[key] = struct{}{}
+			keys = append(keys, key)
+		}
+	}
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		for _, c := range cascades[t] {
+			action := strings.ToUpper(c.onDelete)
+			if action == "" || action == "NO ACTION" || action == "RESTRICT" {
+				continue
+			}
+			add(NewTableKey(c.table))
+			if c.dependent == "" {
+				continue
+			}
+			add(NewTypeKey(c.dependent))
+			if _, ok := visited[c.dependent]; !ok && action == "CASCADE" {
+				visited[c.dependent] = struct{}{}
+				queue = append(queue, c.dependent)
+			}
+		}
+	}
+	return keys
+}
+
+// snake converts the given struct or field name into a snake_case, the same as ent codegen.
+func snake(s string) string {
+	var (
+		j int
+		b strings.Builder
+	)
+	for i := 0; i < len(s); i++ {
+		r := rune(s[i])
+		// Put '_' if it is not a start or end of a word, current letter is uppercase,
+		// and previous is lowercase (cases like: "UserInfo"), or next letter is also
+		// a lowercase and previous letter is not "_".
+		if i > 0 && i < len(s)-1 && unicode.IsUpper(r) {
+			if unicode.IsLower(rune(s[i-1])) ||
+				j != i-1 && unicode.IsLower(rune(s[i+1])) && unicode.IsLetter(rune(s[i-1])) {
+				j = i
+				b.WriteString("_")
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,151 @@
+package entcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tsingsun/woocoo/pkg/cache"
+)
+
+const defaultSnapshotKey = "entcache:snapshot"
+
+var (
+	_ SnapshotStore = (*FileSnapshot)(nil)
+	_ SnapshotStore = (*CacheSnapshot)(nil)
+)
+
+// SnapshotStore persists the snapshot of a MemoryChangeSet, so that the changes recorded just before a restart
+// are kept while the entries still live in a shared cache. See WithSnapshot.
+//
+// The snapshot holds the change marks and the refs only. The lost times of the shards, which stand for the type
+// and table marks dropped by the size bound, are not persisted, so the dropped marks are lost over a restart.
+type SnapshotStore interface {
+	// Save stores the snapshot.
+	Save(ctx context.Context, data []byte) error
+	// Load returns the stored snapshot, or nil if there is none.
+	Load(ctx context.Context) ([]byte, error)
+}
+
+// snapshot is the persisted form of the MemoryChangeSet, the times are in unix nanoseconds.
+type snapshot struct {
+	Changes map[Key]int64 `json:"changes"`
+	Refs    map[Key]int64 `json:"refs"`
+}
+
+// FileSnapshot is a SnapshotStore keeping the snapshot in a local file.
+type FileSnapshot struct {
+	path string
+}
+
+// NewFileSnapshot creates a FileSnapshot of the file path.
+func NewFileSnapshot(path string) *FileSnapshot {
+	return &FileSnapshot{path: path}
+}
+
+// Save implements the SnapshotStore interface. The file is replaced atomically.
+func (f *FileSnapshot) Save(_ context.Context, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// Load implements the SnapshotStore interface.
+func (f *FileSnapshot) Load(context.Context) ([]byte, error) {
+	data, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// CacheSnapshot is a SnapshotStore keeping the snapshot in a cache.Cache, such as redis, so that it survives
+// the loss of the local disk. The snapshot expires after the ttl, that should be at least the retention of the
+// ChangeSet, see ChangeSetStats.Retention, which is the longest TTL of the entries and not less than the gc
+// interval. A shorter ttl drops the marks still in the retention.
+type CacheSnapshot struct {
+	cache cache.Cache
+	key   string
+	ttl   time.Duration
+}
+
+// NewCacheSnapshot creates a CacheSnapshot of the key, default is "entcache:snapshot". The key should be unique
+// per instance.
+func NewCacheSnapshot(c cache.Cache, key string, ttl time.Duration) *CacheSnapshot {
+	if key == "" {
+		key = defaultSnapshotKey
+	}
+	return &CacheSnapshot{cache: c, key: key, ttl: ttl}
+}
+
+// Save implements the SnapshotStore interface.
+func (c *CacheSnapshot) Save(ctx context.Context, data []byte) error {
+	return c.cache.Set(ctx, c.key, data, cache.WithTTL(c.ttl), cache.WithSkip(cache.SkipLocal))
+}
+
+// Load implements the SnapshotStore interface.
+func (c *CacheSnapshot) Load(ctx context.Context) ([]byte, error) {
+	var data []byte
+	if err := c.cache.Get(ctx, c.key, &data, cache.WithSkip(cache.SkipLocal)); err != nil {
+		if c.cache.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// save snapshots the changes and refs to the store.
+func (a *MemoryChangeSet) save(ctx context.Context) error {
+	s := snapshot{
+		Changes: make(map[Key]int64),
+		Refs:    make(map[Key]int64),
+	}
+	a.changes.each(func(k Key, t time.Time) {
+		s.Changes[k] = t.UnixNano()
+	})
+	a.refs.each(func(k Key, t time.Time) {
+		s.Refs[k] = t.UnixNano()
+	})
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return a.snapshot.Save(ctx, data)
+}
+
+// load reloads the snapshot from the store, the marks recorded since are kept if they are later. The marks are
+// not pruned here, as the retention is extended by the Driver after the change set is created, the ones out of
+// the retention are pruned by the gc run on Start.
+func (a *MemoryChangeSet) load(ctx context.Context) error {
+	data, err := a.snapshot.Load(ctx)
+	if err != nil || len(data) == 0 {
+		return err
+	}
+	var s snapshot
+	if err = json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	restore := func(dst *marks, src map[Key]int64) {
+		for k, v := range src {
+			dst.upgrade(k, time.Unix(0, v))
+		}
+	}
+	restore(a.changes, s.Changes)
+	restore(a.refs, s.Refs)
+	return nil
+}
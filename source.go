@@ -0,0 +1,51 @@
+package entcache
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// ChangeSource feeds the changes made out of the Driver, such as by batch jobs, services in other languages
+// or manual fixes, into the ChangeSet. The sources are watched by ChangeSet.Start.
+//
+// A source may implement EvictDelay() time.Duration to have the keys delivered again after the delay, that evicts
+// the stale entries cached by the queries racing with the change. The keys delivered again only evict the
+// entries, they are not published to the subscribers again.
+type ChangeSource interface {
+	// Watch calls fn with the changed keys. It blocks until the context is done or the watch fails.
+	Watch(ctx context.Context, fn func(keys ...Key)) error
+	// Close releases the resources held by the source.
+	Close() error
+}
+
+// watchSource watches the source, it rewatches after a failure until the context is done. If the source has an
+// evict delay, the keys are passed to evict again after it.
+func watchSource(ctx context.Context, src ChangeSource, fn, evict func(keys ...Key)) {
+	deliver := fn
+	if d, ok := src.(interface{ EvictDelay() time.Duration }); ok && d.EvictDelay() > 0 {
+		delay := d.EvictDelay()
+		deliver = func(keys ...Key) {
+			fn(keys...)
+			time.AfterFunc(delay, func() {
+				if ctx.Err() == nil {
+					evict(keys...)
+				}
+			})
+		}
+	}
+	for {
+		err := src.Watch(ctx, deliver)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn(fmt.Sprintf("entcache: change source %T failed: %v", src, err))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
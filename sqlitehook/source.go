@@ -0,0 +1,184 @@
+// Package sqlitehook provides an entcache.ChangeSource based on the update hook of mattn/go-sqlite3, which
+// reports every row changed on the connections, include the raw sql writes bypassing ent.
+//
+// It is kept apart from the entcache package, so that only the users of it depend on cgo.
+package sqlitehook
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/woocoos/entcache"
+)
+
+const defaultEvictDelay = time.Second
+
+var _ entcache.ChangeSource = (*Source)(nil)
+
+// Source is an entcache.ChangeSource receiving the row changes from the sqlite update hook. The changes of a
+// transaction are buffered on its connection, they are delivered after commit and dropped on rollback.
+//
+// A changed row marks the entity by its rowid and the table changed. The rowid is the primary key of the tables
+// with an INTEGER PRIMARY KEY, which is the ent default; for the other tables, see WithoutRowID.
+//
+// SQLite does not call the update hook for the rows deleted by the truncate optimization, that is a DELETE without
+// WHERE on a table without triggers, such as the Delete of ent without predicates, nor for the rows deleted by the
+// REPLACE conflict resolution. These changes are not delivered, they are recorded by entcache.DataChangeNotify for
+// the mutations of ent, or must be invalidated explicitly, such as by entcache.Driver.InvalidateType.
+//
+// The hooks are registered by ConnectHook, that replaces the commit, rollback and update hooks of the connection.
+type Source struct {
+	// types maps the table to the entity type, the tables not mapped are resolved by entcache.TypeName.
+	types map[string]string
+	// noRowID holds the tables whose rowid is not the primary key.
+	noRowID    map[string]struct{}
+	evictDelay time.Duration
+
+	mu      sync.Mutex
+	pending map[entcache.Key]struct{}
+	order   []entcache.Key
+	notify  chan struct{}
+}
+
+// Option configures the Source.
+type Option func(*Source)
+
+// WithTableType maps the table to the entity type, it is required if the type differs from the
+// entcache.TypeName of the table and not registered by entcache.RegisterTable.
+func WithTableType(table, typ string) Option {
+	return func(s *Source) {
+		s.types[table] = typ
+	}
+}
+
+// WithoutRowID sets the tables whose rowid is not the primary key, such as the tables with a text id. The changes
+// of them mark the whole type changed.
+func WithoutRowID(tables ...string) Option {
+	return func(s *Source) {
+		for _, t := range tables {
+			s.noRowID[t] = struct{}{}
+		}
+	}
+}
+
+// WithEvictDelay sets the delay to deliver the changes again, that evicts the stale entries cached by the
+// queries racing with the commit. The changes delivered again are not published to the subscribers, see
+// EvictDelay. Default is 1 second, 0 disables it.
+func WithEvictDelay(delay time.Duration) Option {
+	return func(s *Source) {
+		s.evictDelay = delay
+	}
+}
+
+// New creates a Source.
+func New(opts ...Option) *Source {
+	s := &Source{
+		types:      make(map[string]string),
+		noRowID:    make(map[string]struct{}),
+		evictDelay: defaultEvictDelay,
+		pending:    make(map[entcache.Key]struct{}),
+		notify:     make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Register registers a sqlite3 database/sql driver of the name, whose connections report the changes to s.
+//
+//	src := sqlitehook.New()
+//	src.Register("sqlite3_entcache")
+//	db, err := sql.Open("sqlite3_entcache", "file:ent?mode=memory&cache=shared&_fk=1")
+func (s *Source) Register(name string) {
+	sql.Register(name, &sqlite3.SQLiteDriver{ConnectHook: s.ConnectHook})
+}
+
+// ConnectHook registers the hooks on the connection, it is used as the ConnectHook of sqlite3.SQLiteDriver.
+func (s *Source) ConnectHook(conn *sqlite3.SQLiteConn) error {
+	// the connection is used by one goroutine at a time, the buffer needs no lock.
+	var changes []entcache.Key
+	conn.RegisterUpdateHook(func(_ int, _ string, table string, rowid int64) {
+		changes = append(changes, s.keys(table, rowid)...)
+	})
+	conn.RegisterCommitHook(func() int {
+		s.store(changes)
+		changes = nil
+		return 0
+	})
+	conn.RegisterRollbackHook(func() {
+		changes = nil
+	})
+	return nil
+}
+
+// keys returns the changed keys of the row.
+func (s *Source) keys(table string, rowid int64) []entcache.Key {
+	typ, ok := s.types[table]
+	if !ok {
+		typ = entcache.TypeName(table)
+	}
+	if _, ok := s.noRowID[table]; ok {
+		return []entcache.Key{entcache.NewTableKey(table), entcache.NewTypeKey(typ)}
+	}
+	return []entcache.Key{entcache.NewTableKey(table), entcache.NewEntryKey(typ, strconv.FormatInt(rowid, 10))}
+}
+
+// store adds the keys to the pending keys and notifies the watcher, it never blocks the writer.
+func (s *Source) store(keys []entcache.Key) {
+	if len(keys) == 0 {
+		return
+	}
+	s.mu.Lock()
+	for _, key := range keys {
+		if _, ok := s.pending[key]; !ok {
+			s.pending[key] = struct{}{}
+			s.order = append(s.order, key)
+		}
+	}
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the pending keys and clears them.
+func (s *Source) take() []entcache.Key {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.order
+	s.order = nil
+	s.pending = make(map[entcache.Key]struct{})
+	return keys
+}
+
+// Watch implements the entcache.ChangeSource interface.
+func (s *Source) Watch(ctx context.Context, fn func(keys ...entcache.Key)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.notify:
+			keys := s.take()
+			if len(keys) == 0 {
+				continue
+			}
+			fn(keys...)
+		}
+	}
+}
+
+// EvictDelay returns the delay after which the ChangeSet delivers the changes again for eviction only.
+func (s *Source) EvictDelay() time.Duration {
+	return s.evictDelay
+}
+
+// Close implements the entcache.ChangeSource interface.
+func (s *Source) Close() error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package sqlitehook
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/woocoos/entcache"
+)
+
+// drivers counts the registered drivers, a driver name can not be registered twice, such as by -count.
+var drivers atomic.Int64
+
+// register registers the source by a unique driver name and returns it.
+func register(src *Source) string {
+	name := fmt.Sprintf("sqlite3_hook_test_%d", drivers.Add(1))
+	src.Register(name)
+	return name
+}
+
+func TestSource(t *testing.T) {
+	src := New(WithTableType("accounts", "Member"), WithoutRowID("tokens"), WithEvictDelay(0))
+	db, err := sql.Open(register(src), "file:hook?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("create table accounts (id integer primary key, name text)")
+	require.NoError(t, err)
+	_, err = db.Exec("create table tokens (id text primary key)")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan []entcache.Key, 10)
+	go src.Watch(ctx, func(keys ...entcache.Key) { //nolint:errcheck
+		received <- keys
+	})
+	receive := func() []entcache.Key {
+		select {
+		case keys := <-received:
+			return keys
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	_, err = db.Exec("insert into accounts (id, name) values (1, 'a')")
+	require.NoError(t, err)
+	assert.Equal(t, []entcache.Key{"table:accounts", "Member:1"}, receive())
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("update accounts set name = 'b' where id = 1")
+	require.NoError(t, err)
+	require.NoError(t, tx.Rollback())
+
+	tx, err = db.Begin()
+	require.NoError(t, err)
+	_, err = tx.Exec("insert into tokens (id) values ('x')")
+	require.NoError(t, err)
+	_, err = tx.Exec("delete from accounts where id = 1")
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+	assert.Equal(t, []entcache.Key{"table:tokens", "Token:*", "table:accounts", "Member:1"}, receive(),
+		"the rolled back changes are dropped")
+}
+
+func TestChangeSet(t *testing.T) {
+	src := New(WithEvictDelay(200 * time.Millisecond))
+	db, err := sql.Open(register(src), "file:hookcs?mode=memory&cache=shared")
+	require.NoError(t, err)
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cs := entcache.NewChangeSet(time.Minute, entcache.WithChangeSource(src))
+	events := cs.Subscribe(ctx, entcache.ChangeFilter{Types: []string{"User"}})
+	go cs.Start(ctx) //nolint:errcheck
+	_, err = db.Exec("create table users (id integer primary key, name text)")
+	require.NoError(t, err)
+	_, err = db.Exec("insert into users (id, name) values (1, 'a')")
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		_, ok := cs.Load("User:1")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	cs.Delete("User:1")
+	assert.Eventually(t, func() bool {
+		_, ok := cs.Load("User:1")
+		return ok
+	}, time.Second, 10*time.Millisecond, "delivered again after the delay")
+	e := <-events
+	assert.Equal(t, []string{"1"}, e.IDs)
+	assert.Zero(t, e.Op)
+	select {
+	case e = <-events:
+		t.Fatalf("the changes delivered again are published: %v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -3,7 +3,12 @@ package entcache
 import (
 	"context"
 	"database/sql/driver"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -11,36 +16,231 @@ type (
 	Entry struct {
 		Columns []string
 		Values  [][]driver.Value
+		// StaleAt is the unix nanoseconds after which the entry is stale and refreshed in background, 0 if it
+		// never goes stale, see Config.SoftTTL.
+		StaleAt int64
 	}
 
 	Key string
 )
 
+// stale reports whether the entry is past its soft TTL.
+func (e *Entry) stale() bool {
+	return e.StaleAt != 0 && time.Now().UnixNano() > e.StaleAt
+}
+
 func NewEntryKey(typ string, id string) Key {
 	return Key(typ + ":" + id)
 }
 
+// NewFieldKey returns the key marking the field of the entity changed, the field is the column of it in the
+// table. The key with an empty field marks some fields of the entity changed, which evicts the queries reading
+// all fields such as Get.
+func NewFieldKey(typ, id, field string) Key {
+	return fieldKey(NewEntryKey(typ, id), field)
+}
+
+// fieldKey returns the field key of the entry key.
+func fieldKey(key Key, field string) Key {
+	return key + "#" + Key(field)
+}
+
+// CompositeID returns the canonical form of a composite id of an edge schema, which is the values of the id
+// fields joined by "," in the order of the fields, such as "1,2" for the id fields user_id and group_id.
+func CompositeID(values ...any) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = fmt.Sprint(v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// NewTypeKey returns the key marking all entities of the type changed. It is used when the changed
+// entities can not be determined.
+func NewTypeKey(typ string) Key {
+	return NewEntryKey(typ, "*")
+}
+
+// NewTableKey returns the key marking the table changed, the hash queries reading the table are evicted by it.
+func NewTableKey(table string) Key {
+	return Key("table:" + table)
+}
+
+// entryType returns the type of the entry key.
+func entryType(key Key) string {
+	typ, _, _ := strings.Cut(string(key), ":")
+	return typ
+}
+
 // ChangeSet is a set of keys that have changed, include update, delete, create.
-type ChangeSet struct {
-	sync.RWMutex
-	changes    map[Key]time.Time
-	refs       map[Key]time.Time
+//
+// Refs record the time of the latest query of the reference entries(see WithRefEntryKey) in a changed period,
+// the Driver compares it with the change time to decide whether to evict the cached entry.
+type ChangeSet interface {
+	// Start runs the background work such as gc. It blocks until the context is done.
+	Start(ctx context.Context) error
+	// Stop stops the background work.
+	Stop(ctx context.Context) error
+	// Store marks the keys changed.
+	Store(keys ...Key)
+	// Load returns the time when the key was changed.
+	Load(key Key) (time.Time, bool)
+	// Delete removes the change mark of the key.
+	Delete(key Key)
+	// LoadRef returns the time when the reference entry was queried.
+	LoadRef(key Key) (time.Time, bool)
+	// LoadOrStoreRef returns the previous query time of the reference entry and stores the current time.
+	LoadOrStoreRef(key Key) (t time.Time, loaded bool)
+	// DeleteRef removes the query time of the reference entry.
+	DeleteRef(key Key)
+	// Subscribe returns the channel of the change events matching the filter, it is closed when the context is
+	// done. Each subscription has a bounded buffer, the events are dropped by the DropPolicy when it is full.
+	// The Driver publishes the change events only to the ChangeSets of this package, other implementations
+	// receive the changes by Store.
+	Subscribe(ctx context.Context, filter ChangeFilter, opts ...SubscribeOption) <-chan ChangeEvent
+}
+
+var _ ChangeSet = (*MemoryChangeSet)(nil)
+
+const (
+	// changeSetShards is the number of the shards of the marks, a power of 2.
+	changeSetShards = 64
+	// evictFraction is the fraction of a full shard made room at once, see marks.evict.
+	evictFraction = 8
+	// defaultChangeSetSize is the default max number of the change marks, and of the refs.
+	defaultChangeSetSize = 1 << 20
+	// defaultPublishTimeout is the default time limit of publishing the changed keys to the Transport.
+	defaultPublishTimeout = time.Second
+)
+
+// MemoryChangeSet is a ChangeSet in process memory. Use a Transport to share the changes between processes.
+//
+// The change marks and the refs are kept in sharded maps, each bounded by the max size. A mark is retained as long
+// as an entry cached before it may live, that is the longest TTL of the entries reported by the Driver, and not
+// less than the gc interval. When a shard is full, the oldest marks are dropped in a batch: a dropped change mark
+// of an entity is replaced by the mark of its type, which evicts more entries but never keeps a stale one; a
+// dropped mark of a type or table is kept as the lost time of its shard, by which every type and table key of
+// the shard is reported changed until it is out of the retention; a dropped ref only causes an extra eviction.
+type MemoryChangeSet struct {
+	changes    *marks
+	refs       *marks
 	gcInterval time.Duration
+	maxSize    int
+	// retention is the longest TTL of the entries in nanoseconds, see retain.
+	retention atomic.Int64
+	// transport propagates the changed keys to the other nodes.
+	transport      Transport
+	publishTimeout time.Duration
+	node           string
+	sources        []ChangeSource
+	snapshot       SnapshotStore
+	feed           changeFeed
+
+	mu sync.RWMutex
+	// receivers are notified of the keys stored not by the Driver, remote reports whether they are received
+	// from the other nodes, or from the sources otherwise.
+	receivers []func(keys []Key, remote bool)
+	// collectors are run by gc, such as removing the expired entries of the Driver.
+	collectors []func()
+}
+
+// ChangeSetStats are the metrics of the MemoryChangeSet.
+type ChangeSetStats struct {
+	// Changes is the number of the change marks.
+	Changes int
+	// Refs is the number of the refs.
+	Refs int
+	// DroppedChanges is the number of the change marks dropped by the size bound.
+	DroppedChanges uint64
+	// DroppedRefs is the number of the refs dropped by the size bound.
+	DroppedRefs uint64
+	// Retention is the time the marks are retained.
+	Retention time.Duration
+}
+
+// ChangeSetOption configures the MemoryChangeSet.
+type ChangeSetOption func(*MemoryChangeSet)
+
+// WithTransport sets the Transport which the changed keys are published to and received from.
+func WithTransport(tr Transport) ChangeSetOption {
+	return func(a *MemoryChangeSet) {
+		a.transport = tr
+	}
+}
+
+// WithPublishTimeout sets the time limit of publishing the changed keys to the Transport, default is 1 second.
+// Store runs on the mutation path, the limit bounds the delay of a write when the Transport is slow or down,
+// the keys failed to publish are only marked locally.
+func WithPublishTimeout(timeout time.Duration) ChangeSetOption {
+	return func(a *MemoryChangeSet) {
+		a.publishTimeout = timeout
+	}
+}
+
+// WithChangeSource adds a ChangeSource, the changes of it are stored and published to the Transport.
+func WithChangeSource(src ChangeSource) ChangeSetOption {
+	return func(a *MemoryChangeSet) {
+		a.sources = append(a.sources, src)
+	}
+}
+
+// WithSnapshot sets the SnapshotStore, the marks are saved on Stop and reloaded by NewChangeSet. The reloaded
+// marks out of the retention are pruned on Start.
+func WithSnapshot(store SnapshotStore) ChangeSetOption {
+	return func(a *MemoryChangeSet) {
+		a.snapshot = store
+	}
+}
+
+// WithMaxSize sets the max number of the change marks, and of the refs, default is 1048576.
+func WithMaxSize(size int) ChangeSetOption {
+	return func(a *MemoryChangeSet) {
+		a.maxSize = size
+	}
 }
 
-func NewChangeSet(gcInterval time.Duration) *ChangeSet {
-	a := &ChangeSet{
-		changes:    make(map[Key]time.Time),
-		refs:       make(map[Key]time.Time),
-		gcInterval: gcInterval,
+// NewChangeSet creates a MemoryChangeSet, the gc runs every gcInterval, and the marks are retained for at least
+// gcInterval. If a SnapshotStore is set, the saved marks in the retention are reloaded.
+func NewChangeSet(gcInterval time.Duration, opts ...ChangeSetOption) *MemoryChangeSet {
+	a := &MemoryChangeSet{
+		gcInterval:     gcInterval,
+		maxSize:        defaultChangeSetSize,
+		publishTimeout: defaultPublishTimeout,
+		node:           newNodeID(),
 	}
 	if a.gcInterval <= 0 {
 		a.gcInterval = defaultGCInterval
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.maxSize <= 0 {
+		a.maxSize = defaultChangeSetSize
+	}
+	if a.publishTimeout <= 0 {
+		a.publishTimeout = defaultPublishTimeout
+	}
+	a.retention.Store(int64(a.gcInterval))
+	a.changes = newMarks(a.maxSize)
+	a.refs = newMarks(a.maxSize)
+	if a.snapshot != nil {
+		if err := a.load(context.Background()); err != nil {
+			logger.Warn(fmt.Sprintf("entcache: failed loading change set snapshot: %v", err))
+		}
+	}
 	return a
 }
 
-func (a *ChangeSet) Start(ctx context.Context) error {
+// Start runs the gc loop, subscribes the Transport if set and watches the sources. It blocks until the context
+// is done. The marks restored from the snapshot are pruned by the retention at first.
+func (a *MemoryChangeSet) Start(ctx context.Context) error {
+	a.gc()
+	if a.transport != nil {
+		go a.subscribe(ctx)
+	}
+	for _, src := range a.sources {
+		go watchSource(ctx, src, a.storeSource, a.evictSource)
+	}
 	t := time.NewTicker(a.gcInterval)
 	defer t.Stop()
 	for {
@@ -53,70 +253,371 @@ func (a *ChangeSet) Start(ctx context.Context) error {
 	}
 }
 
-func (a *ChangeSet) Stop(ctx context.Context) error {
-	return nil
+// Stop stops the sources and the Transport, and saves the snapshot if a SnapshotStore is set.
+func (a *MemoryChangeSet) Stop(ctx context.Context) error {
+	var errs []error
+	if a.snapshot != nil {
+		errs = append(errs, a.save(ctx))
+	}
+	for _, src := range a.sources {
+		errs = append(errs, src.Close())
+	}
+	if a.transport != nil {
+		errs = append(errs, a.transport.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Stats returns the metrics of the change set.
+func (a *MemoryChangeSet) Stats() ChangeSetStats {
+	return ChangeSetStats{
+		Changes:        a.changes.len(),
+		Refs:           a.refs.len(),
+		DroppedChanges: a.changes.dropped.Load(),
+		DroppedRefs:    a.refs.dropped.Load(),
+		Retention:      a.retentionPeriod(),
+	}
 }
 
-func (a *ChangeSet) gc() {
-	a.Lock()
-	defer a.Unlock()
-	for k, v := range a.changes {
-		if time.Since(v) > a.gcInterval {
-			delete(a.changes, k)
+// retain extends the retention of the marks to the ttl of an entry, if it is longer.
+func (a *MemoryChangeSet) retain(ttl time.Duration) {
+	for {
+		cur := a.retention.Load()
+		if int64(ttl) <= cur || a.retention.CompareAndSwap(cur, int64(ttl)) {
+			return
 		}
 	}
-	for k, v := range a.refs {
-		if time.Since(v) > a.gcInterval {
-			delete(a.refs, k)
+}
+
+func (a *MemoryChangeSet) retentionPeriod() time.Duration {
+	return time.Duration(a.retention.Load())
+}
+
+// subscribe receives the changed keys from the other nodes, it resubscribes after a failure until
+// the context is done.
+func (a *MemoryChangeSet) subscribe(ctx context.Context) {
+	for {
+		err := a.transport.Subscribe(ctx, a.receive)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn(fmt.Sprintf("entcache: change set subscription failed: %v", err))
 		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// receive stores the keys changed by other nodes. The local time is used rather than the time of publisher,
+// that avoids the clock skew between nodes.
+func (a *MemoryChangeSet) receive(msg *ChangeMessage) {
+	if msg.Node == a.node || len(msg.Keys) == 0 {
+		return
 	}
+	a.store(time.Now(), msg.Keys...)
+	a.notify(msg.Keys, true)
+	a.feed.publish(keyEvents(msg.Keys)...)
 }
 
-func (a *ChangeSet) Store(keys ...Key) {
-	a.Lock()
-	defer a.Unlock()
+// storeSource stores the keys changed by the sources.
+func (a *MemoryChangeSet) storeSource(keys ...Key) {
+	if len(keys) == 0 {
+		return
+	}
+	a.evictSource(keys...)
+	a.feed.publish(keyEvents(keys)...)
+}
+
+// evictSource stores the keys of the sources without publishing the events, such as the keys delivered again
+// after the evict delay of a source.
+func (a *MemoryChangeSet) evictSource(keys ...Key) {
+	if len(keys) == 0 {
+		return
+	}
+	a.Store(keys...)
+	a.notify(keys, false)
+}
+
+func (a *MemoryChangeSet) notify(keys []Key, remote bool) {
+	a.mu.RLock()
+	receivers := a.receivers
+	a.mu.RUnlock()
+	for _, fn := range receivers {
+		fn(keys, remote)
+	}
+}
+
+// onReceive registers the function notified of the keys stored not by the Driver.
+func (a *MemoryChangeSet) onReceive(fn func(keys []Key, remote bool)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.receivers = append(a.receivers, fn)
+}
+
+// onGC registers the function run by gc.
+func (a *MemoryChangeSet) onGC(fn func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.collectors = append(a.collectors, fn)
+}
+
+func (a *MemoryChangeSet) gc() {
+	before := time.Now().Add(-a.retentionPeriod())
+	a.changes.expire(before)
+	a.refs.expire(before)
+	a.mu.RLock()
+	collectors := a.collectors
+	a.mu.RUnlock()
+	for _, fn := range collectors {
+		fn()
+	}
+}
+
+// Store marks the keys changed, and publishes them to the Transport if set, see WithPublishTimeout.
+func (a *MemoryChangeSet) Store(keys ...Key) {
 	t := time.Now()
+	a.store(t, keys...)
+	if a.transport == nil || len(keys) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.publishTimeout)
+	defer cancel()
+	err := a.transport.Publish(ctx, &ChangeMessage{Node: a.node, Keys: keys, Time: t})
+	if err != nil {
+		logger.Warn(fmt.Sprintf("entcache: failed publishing changed keys %v: %v", keys, err))
+	}
+}
+
+func (a *MemoryChangeSet) store(t time.Time, keys ...Key) {
+	before := t.Add(-a.retentionPeriod())
 	for _, key := range keys {
-		a.changes[key] = t
+		for _, v := range a.changes.set(key, t, before) {
+			if coarseKey(v.key) {
+				a.changes.lose(v.key, v.t)
+			} else {
+				// the entity of the dropped mark is covered by the mark of its type.
+				a.changes.upgrade(NewTypeKey(entryType(v.key)), v.t)
+			}
+		}
 	}
 }
 
-func (a *ChangeSet) Load(key Key) (time.Time, bool) {
-	a.RLock()
-	defer a.RUnlock()
+// Load returns the time of the change mark. A type or table key missing in a shard which lost such marks is
+// reported changed at the lost time.
+func (a *MemoryChangeSet) Load(key Key) (time.Time, bool) {
+	if t, ok := a.changes.get(key); ok || !coarseKey(key) {
+		return t, ok
+	}
+	return a.changes.lost(key)
+}
 
-	v, ok := a.changes[key]
-	return v, ok
+// coarseKey reports whether the key is a type or table key, which covers many entities.
+func coarseKey(key Key) bool {
+	return strings.HasSuffix(string(key), ":*") || strings.HasPrefix(string(key), "table:")
 }
 
-func (a *ChangeSet) Delete(key Key) {
-	a.Lock()
-	defer a.Unlock()
+func (a *MemoryChangeSet) Delete(key Key) {
+	a.changes.del(key)
+}
 
-	delete(a.changes, key)
+func (a *MemoryChangeSet) LoadRef(key Key) (time.Time, bool) {
+	return a.refs.get(key)
 }
 
-func (a *ChangeSet) LoadRef(key Key) (time.Time, bool) {
-	a.RLock()
-	defer a.RUnlock()
+// LoadOrStoreRef returns the time when the key was last updated.
+func (a *MemoryChangeSet) LoadOrStoreRef(key Key) (t time.Time, loaded bool) {
+	now := time.Now()
+	return a.refs.swap(key, now, now.Add(-a.retentionPeriod()))
+}
 
-	v, ok := a.refs[key]
-	return v, ok
+func (a *MemoryChangeSet) DeleteRef(key Key) {
+	a.refs.del(key)
 }
 
-// LoadOrStoreRef returns the time when the key was last updated.
-func (a *ChangeSet) LoadOrStoreRef(key Key) (t time.Time, loaded bool) {
-	a.Lock()
-	defer a.Unlock()
+// Subscribe implements the ChangeSet interface. The changes received from the other instances and the change
+// sources are published as well. They carry only the keys, so the events have the Type, the IDs of the changed
+// entities, the Fields of the field keys and the Time, with the unknown operation; a change of a table alone,
+// without the keys of its type, is not published.
+func (a *MemoryChangeSet) Subscribe(ctx context.Context, filter ChangeFilter, opts ...SubscribeOption) <-chan ChangeEvent {
+	return a.feed.subscribe(ctx, filter, opts...)
+}
 
-	t, loaded = a.refs[key]
-	a.refs[key] = time.Now()
-	return
+func (a *MemoryChangeSet) publish(events ...ChangeEvent) {
+	a.feed.publish(events...)
 }
 
-func (a *ChangeSet) DeleteRef(key Key) {
-	a.Lock()
-	defer a.Unlock()
+// marks is a sharded map from the keys to their times, bounded by the max size.
+type marks struct {
+	shards [changeSetShards]markShard
+	// limit is the max size of a shard.
+	limit   int
+	dropped atomic.Uint64
+}
 
-	delete(a.refs, key)
+type markShard struct {
+	sync.RWMutex
+	m map[Key]time.Time
+	// lost is the latest time of the marks dropped without a replacement, see lose.
+	lost time.Time
+}
+
+// mark is a key and its time.
+type mark struct {
+	key Key
+	t   time.Time
+}
+
+func newMarks(size int) *marks {
+	m := &marks{limit: (size + changeSetShards - 1) / changeSetShards}
+	for i := range m.shards {
+		m.shards[i].m = make(map[Key]time.Time)
+	}
+	return m
+}
+
+// shard returns the shard of the key by its FNV-1a hash.
+func (m *marks) shard(key Key) *markShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &m.shards[h&(changeSetShards-1)]
+}
+
+func (m *marks) get(key Key) (time.Time, bool) {
+	s := m.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	t, ok := s.m[key]
+	return t, ok
+}
+
+func (m *marks) del(key Key) {
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	delete(s.m, key)
+}
+
+// lost returns the lost time of the shard of the key.
+func (m *marks) lost(key Key) (time.Time, bool) {
+	s := m.shard(key)
+	s.RLock()
+	defer s.RUnlock()
+	return s.lost, !s.lost.IsZero()
+}
+
+// lose records the time of the dropped key as the lost time of its shard, if it is later.
+func (m *marks) lose(key Key, t time.Time) {
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	if t.After(s.lost) {
+		s.lost = t
+	}
+}
+
+// set stores the time of the key. If the shard is full, the marks are evicted and the dropped ones are returned.
+func (m *marks) set(key Key, t, before time.Time) []mark {
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	dropped := m.evict(s, key, before)
+	s.m[key] = t
+	return dropped
+}
+
+// swap stores the time of the key and returns the previous one, it evicts the same as set.
+func (m *marks) swap(key Key, t, before time.Time) (time.Time, bool) {
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	prev, loaded := s.m[key]
+	m.evict(s, key, before)
+	s.m[key] = t
+	return prev, loaded
+}
+
+// upgrade stores the time of the key if it is later, it is not bounded, since the keys upgraded to are few.
+func (m *marks) upgrade(key Key, t time.Time) {
+	s := m.shard(key)
+	s.Lock()
+	defer s.Unlock()
+	if cur, ok := s.m[key]; !ok || t.After(cur) {
+		s.m[key] = t
+	}
+}
+
+// evict makes room in the full shard for the key, the caller must hold the lock. The marks before the time are
+// expired, then the oldest ones are dropped until a fraction of the shard is free, so that the shard is scanned
+// once per batch of inserts rather than on every insert.
+func (m *marks) evict(s *markShard, key Key, before time.Time) []mark {
+	if _, ok := s.m[key]; ok || len(s.m) < m.limit {
+		return nil
+	}
+	all := make([]mark, 0, len(s.m))
+	for k, t := range s.m {
+		if t.Before(before) {
+			delete(s.m, k)
+			continue
+		}
+		all = append(all, mark{key: k, t: t})
+	}
+	n := len(s.m) - m.limit + max(m.limit/evictFraction, 1)
+	if n <= 0 {
+		return nil
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].t.Before(all[j].t)
+	})
+	for _, v := range all[:n] {
+		delete(s.m, v.key)
+	}
+	m.dropped.Add(uint64(n))
+	return all[:n]
+}
+
+// expire removes the marks before the time.
+func (m *marks) expire(before time.Time) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.Lock()
+		for k, t := range s.m {
+			if t.Before(before) {
+				delete(s.m, k)
+			}
+		}
+		if s.lost.Before(before) {
+			s.lost = time.Time{}
+		}
+		s.Unlock()
+	}
+}
+
+func (m *marks) len() int {
+	var n int
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		n += len(s.m)
+		s.RUnlock()
+	}
+	return n
+}
+
+// each calls fn for all marks, fn must not modify the marks.
+func (m *marks) each(fn func(Key, time.Time)) {
+	for i := range m.shards {
+		s := &m.shards[i]
+		s.RLock()
+		for k, t := range s.m {
+			fn(k, t)
+		}
+		s.RUnlock()
+	}
 }
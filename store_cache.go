@@ -0,0 +1,169 @@
+package entcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tsingsun/woocoo/pkg/cache"
+)
+
+const defaultChangeSetPrefix = "entcache:cs:"
+
+var _ ChangeSet = (*CacheChangeSet)(nil)
+
+// CacheChangeSet is a ChangeSet which keeps the change and ref timestamps in a cache.Cache, the marks are expired
+// by the native expiry of the cache. Using a shared cache such as redis, all instances share one view of which
+// entities changed without a Transport.
+//
+// The local cache layer of redisc is skipped, because a mark must be seen by all instances at once. The refs are
+// kept per instance, each instance evicts the entries it serves, such as from the local cache layer, by its refs.
+type CacheChangeSet struct {
+	cache  cache.Cache
+	prefix string
+	// node is the id of the instance, the refs are kept under it.
+	node    string
+	ttl     time.Duration
+	sources []ChangeSource
+	feed    changeFeed
+}
+
+// CacheChangeSetOption configures the CacheChangeSet.
+type CacheChangeSetOption func(*CacheChangeSet)
+
+// WithChangeSetPrefix sets the prefix of the keys stored in cache, default is "entcache:cs:".
+func WithChangeSetPrefix(prefix string) CacheChangeSetOption {
+	return func(c *CacheChangeSet) {
+		c.prefix = prefix
+	}
+}
+
+// WithCacheChangeSource adds a ChangeSource, the changes of it are stored to the cache.
+func WithCacheChangeSource(src ChangeSource) CacheChangeSetOption {
+	return func(c *CacheChangeSet) {
+		c.sources = append(c.sources, src)
+	}
+}
+
+// NewCacheChangeSet creates a CacheChangeSet, the marks expire after ttl which should not be less than the
+// KeyQueryTTL of Driver.
+func NewCacheChangeSet(cc cache.Cache, ttl time.Duration, opts ...CacheChangeSetOption) *CacheChangeSet {
+	c := &CacheChangeSet{
+		cache:  cc,
+		prefix: defaultChangeSetPrefix,
+		node:   newNodeID(),
+		ttl:    ttl,
+	}
+	if c.ttl <= 0 {
+		c.ttl = defaultGCInterval
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Start implements the ChangeSet interface. The marks are expired by cache, it only watches the sources.
+func (c *CacheChangeSet) Start(ctx context.Context) error {
+	for _, src := range c.sources {
+		go watchSource(ctx, src, c.storeSource, c.Store)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// Stop implements the ChangeSet interface.
+func (c *CacheChangeSet) Stop(context.Context) error {
+	var errs []error
+	for _, src := range c.sources {
+		errs = append(errs, src.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (c *CacheChangeSet) changeKey(key Key) string {
+	return c.prefix + "change:" + string(key)
+}
+
+func (c *CacheChangeSet) refKey(key Key) string {
+	return c.prefix + "ref:" + c.node + ":" + string(key)
+}
+
+func (c *CacheChangeSet) set(k string, t time.Time) {
+	err := c.cache.Set(context.Background(), k, t.UnixNano(), cache.WithTTL(c.ttl), cache.WithSkip(cache.SkipLocal))
+	if err != nil {
+		logger.Warn(fmt.Sprintf("entcache: failed storing change mark %s: %v", k, err))
+	}
+}
+
+func (c *CacheChangeSet) get(k string) (time.Time, bool) {
+	var v int64
+	err := c.cache.Get(context.Background(), k, &v, cache.WithSkip(cache.SkipLocal))
+	if err != nil {
+		if !c.cache.IsNotFound(err) {
+			logger.Warn(fmt.Sprintf("entcache: failed loading change mark %s: %v", k, err))
+		}
+		return time.Time{}, false
+	}
+	return time.Unix(0, v), true
+}
+
+func (c *CacheChangeSet) del(k string) {
+	if err := c.cache.Del(context.Background(), k); err != nil {
+		logger.Warn(fmt.Sprintf("entcache: failed deleting change mark %s: %v", k, err))
+	}
+}
+
+// Store implements the ChangeSet interface.
+func (c *CacheChangeSet) Store(keys ...Key) {
+	t := time.Now()
+	for _, key := range keys {
+		c.set(c.changeKey(key), t)
+	}
+}
+
+// Load implements the ChangeSet interface.
+func (c *CacheChangeSet) Load(key Key) (time.Time, bool) {
+	return c.get(c.changeKey(key))
+}
+
+// Delete implements the ChangeSet interface.
+func (c *CacheChangeSet) Delete(key Key) {
+	c.del(c.changeKey(key))
+}
+
+// LoadRef implements the ChangeSet interface.
+func (c *CacheChangeSet) LoadRef(key Key) (time.Time, bool) {
+	return c.get(c.refKey(key))
+}
+
+// LoadOrStoreRef implements the ChangeSet interface. Note that the load and store are not atomic, concurrent
+// callers may both see the key not loaded, which only causes an extra eviction.
+func (c *CacheChangeSet) LoadOrStoreRef(key Key) (t time.Time, loaded bool) {
+	k := c.refKey(key)
+	t, loaded = c.get(k)
+	c.set(k, time.Now())
+	return
+}
+
+// DeleteRef implements the ChangeSet interface.
+func (c *CacheChangeSet) DeleteRef(key Key) {
+	c.del(c.refKey(key))
+}
+
+// Subscribe implements the ChangeSet interface. The marks in the cache carry no events, a subscription only
+// receives the changes made by this instance and its change sources.
+func (c *CacheChangeSet) Subscribe(ctx context.Context, filter ChangeFilter, opts ...SubscribeOption) <-chan ChangeEvent {
+	return c.feed.subscribe(ctx, filter, opts...)
+}
+
+func (c *CacheChangeSet) publish(events ...ChangeEvent) {
+	c.feed.publish(events...)
+}
+
+// storeSource stores the keys changed by the sources.
+func (c *CacheChangeSet) storeSource(keys ...Key) {
+	c.Store(keys...)
+	c.feed.publish(keyEvents(keys)...)
+}
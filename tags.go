@@ -0,0 +1,164 @@
+package entcache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tsingsun/woocoo/pkg/cache"
+)
+
+// tagPrefix is the prefix of the redis sets holding the keys of the tagged entries, after the CachePrefix.
+const tagPrefix = "entcache:tag:"
+
+var (
+	// addTagScript adds the key to the set and extends the set expiry to the ttl if it is longer.
+	addTagScript = redis.NewScript(`
+redis.call('SADD', KEYS[1], ARGV[1])
+if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 1`)
+	// popTagScript returns the keys of the set and deletes it.
+	popTagScript = redis.NewScript(`
+local keys = redis.call('SMEMBERS', KEYS[1])
+redis.call('DEL', KEYS[1])
+return keys`)
+)
+
+// tagStore holds the mapping from the tags to the keys of the cache entries, see WithTags.
+type tagStore interface {
+	// add maps the tags to the entry key, the mapping expires with the entry after ttl.
+	add(ctx context.Context, key Key, tags []string, ttl time.Duration) error
+	// invalidate removes the entries of the tags and returns the count of the removed entries.
+	invalidate(ctx context.Context, tags []string) (int, error)
+}
+
+// newTagStore returns the tagStore of the cache: redis sets for a redis cache, so that the mapping is shared
+// by all instances, or a map in process memory otherwise.
+func newTagStore(c cache.Cache, prefix string, gcInterval time.Duration) tagStore {
+	if gcInterval <= 0 {
+		gcInterval = defaultGCInterval
+	}
+	if rc, ok := c.(interface{ RedisClient() redis.Cmdable }); ok {
+		return &redisTags{cache: c, client: rc.RedisClient(), prefix: prefix + tagPrefix, gcInterval: gcInterval}
+	}
+	return &memoryTags{cache: c, tags: make(map[string]map[Key]time.Time), gcInterval: gcInterval, lastGC: time.Now()}
+}
+
+// memoryTags is a tagStore in process memory.
+type memoryTags struct {
+	cache cache.Cache
+	mu    sync.Mutex
+	// tags maps the tag to the entry keys and their expiry.
+	tags       map[string]map[Key]time.Time
+	gcInterval time.Duration
+	lastGC     time.Time
+}
+
+func (m *memoryTags) add(_ context.Context, key Key, tags []string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = m.gcInterval
+	}
+	expire := time.Now().Add(ttl)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if time.Since(m.lastGC) > m.gcInterval {
+		m.gc()
+	}
+	for _, tag := range tags {
+		keys, ok := m.tags[tag]
+		if !ok {
+			keys = make(map[Key]time.Time)
+			m.tags[tag] = keys
+		}
+		keys[key] = expire
+	}
+	return nil
+}
+
+func (m *memoryTags) invalidate(ctx context.Context, tags []string) (int, error) {
+	m.mu.Lock()
+	keys := make(map[Key]struct{})
+	for _, tag := range tags {
+		for key := range m.tags[tag] {
+			keys[key] = struct{}{}
+		}
+		delete(m.tags, tag)
+	}
+	m.mu.Unlock()
+	var removed int
+	for key := range keys {
+		if !m.cache.Has(ctx, string(key)) {
+			continue
+		}
+		if err := m.cache.Del(ctx, string(key)); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// gc removes the expired keys, the caller must hold the lock.
+func (m *memoryTags) gc() {
+	now := time.Now()
+	for tag, keys := range m.tags {
+		for key, expire := range keys {
+			if now.After(expire) {
+				delete(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			delete(m.tags, tag)
+		}
+	}
+	m.lastGC = now
+}
+
+// redisTags is a tagStore keeping a redis set of the entry keys per tag.
+type redisTags struct {
+	cache      cache.Cache
+	client     redis.Cmdable
+	prefix     string
+	gcInterval time.Duration
+}
+
+func (r *redisTags) add(ctx context.Context, key Key, tags []string, ttl time.Duration) error {
+	if ttl <= 0 {
+		ttl = r.gcInterval
+	}
+	for _, tag := range tags {
+		err := addTagScript.Run(ctx, r.client, []string{r.prefix + tag}, string(key), ttl.Milliseconds()).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redisTags) invalidate(ctx context.Context, tags []string) (int, error) {
+	local, _ := r.cache.(interface{ DeleteFromLocalCache(string) })
+	var removed int
+	for _, tag := range tags {
+		keys, err := popTagScript.Run(ctx, r.client, []string{r.prefix + tag}).StringSlice()
+		if err != nil {
+			return removed, err
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		if local != nil {
+			for _, key := range keys {
+				local.DeleteFromLocalCache(key)
+			}
+		}
+		n, err := r.client.Del(ctx, keys...).Result()
+		removed += int(n)
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
@@ -0,0 +1,40 @@
+package entcache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Transport propagates the changed keys between the processes that share the same cache entries.
+// ChangeSet.Store publishes to it and ChangeSet.Start subscribes to it, so a change recorded on one node
+// marks the keys on all nodes.
+type Transport interface {
+	// Publish sends the message to all subscribers.
+	Publish(ctx context.Context, msg *ChangeMessage) error
+	// Subscribe receives messages and calls fn for each one. It blocks until the context is done
+	// or the subscription fails.
+	Subscribe(ctx context.Context, fn func(*ChangeMessage)) error
+	// Close releases the resources held by the transport.
+	Close() error
+}
+
+// ChangeMessage is the payload carried by a Transport.
+type ChangeMessage struct {
+	// Node is the id of the publishing ChangeSet, the subscriber uses it to skip its own messages.
+	Node string `json:"node"`
+	// Keys are the changed keys.
+	Keys []Key `json:"keys"`
+	// Time is when the keys were changed at publisher.
+	Time time.Time `json:"time"`
+}
+
+// newNodeID returns a random id identifying a ChangeSet among the processes.
+func newNodeID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
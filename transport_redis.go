@@ -0,0 +1,219 @@
+package entcache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	defaultStreamMaxLen = 10000
+	defaultStreamBlock  = time.Second
+	streamMessageField  = "msg"
+)
+
+var (
+	_ Transport = (*RedisPubSub)(nil)
+	_ Transport = (*RedisStream)(nil)
+)
+
+// RedisPubSub is a Transport based on redis pub/sub.
+//
+// Pub/sub is fire-and-forget, a node which is not subscribed when the message is published never receives it.
+// Use RedisStream if the messages need to be replayed.
+type RedisPubSub struct {
+	client  redis.UniversalClient
+	channel string
+}
+
+// NewRedisPubSub creates a pub/sub Transport on the channel.
+func NewRedisPubSub(client redis.UniversalClient, channel string) *RedisPubSub {
+	return &RedisPubSub{
+		client:  client,
+		channel: channel,
+	}
+}
+
+// Publish implements the Transport interface.
+func (t *RedisPubSub) Publish(ctx context.Context, msg *ChangeMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return t.client.Publish(ctx, t.channel, b).Err()
+}
+
+// Subscribe implements the Transport interface.
+func (t *RedisPubSub) Subscribe(ctx context.Context, fn func(*ChangeMessage)) error {
+	ps := t.client.Subscribe(ctx, t.channel)
+	defer ps.Close()
+	// wait for the subscription confirmation, messages published after that are received.
+	if _, err := ps.Receive(ctx); err != nil {
+		return err
+	}
+	ch := ps.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			msg := new(ChangeMessage)
+			if err := json.Unmarshal([]byte(m.Payload), msg); err != nil {
+				logger.Warn("entcache: invalid change message: " + err.Error())
+				continue
+			}
+			fn(msg)
+		}
+	}
+}
+
+// Close implements the Transport interface. The client is owned by the caller and is not closed.
+func (t *RedisPubSub) Close() error {
+	return nil
+}
+
+// RedisStream is a Transport based on redis streams.
+//
+// The stream keeps a durable log of the messages which is capped by WithStreamMaxLen, a subscriber can replay the
+// log from a given position by WithStreamStartID, and LastID reports the position it has consumed.
+type RedisStream struct {
+	client redis.UniversalClient
+	stream string
+	// maxLen is the approximate max length of the stream.
+	maxLen int64
+	// block is the max duration of a blocking read.
+	block time.Duration
+
+	mu     sync.Mutex
+	lastID string
+}
+
+// RedisStreamOption configures the RedisStream.
+type RedisStreamOption func(*RedisStream)
+
+// WithStreamMaxLen sets the approximate max length of the stream, the older messages are trimmed.
+func WithStreamMaxLen(n int64) RedisStreamOption {
+	return func(t *RedisStream) {
+		t.maxLen = n
+	}
+}
+
+// WithStreamStartID sets the position after which the subscriber starts reading. Use "0" to replay the whole log.
+// Default is "$", that means only the messages published after the subscription are received.
+func WithStreamStartID(id string) RedisStreamOption {
+	return func(t *RedisStream) {
+		t.lastID = id
+	}
+}
+
+// WithStreamBlock sets the max duration of a blocking read, the subscriber checks the context between reads.
+func WithStreamBlock(d time.Duration) RedisStreamOption {
+	return func(t *RedisStream) {
+		t.block = d
+	}
+}
+
+// NewRedisStream creates a stream Transport on the stream key.
+func NewRedisStream(client redis.UniversalClient, stream string, opts ...RedisStreamOption) *RedisStream {
+	t := &RedisStream{
+		client: client,
+		stream: stream,
+		maxLen: defaultStreamMaxLen,
+		block:  defaultStreamBlock,
+		lastID: "$",
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// Publish implements the Transport interface.
+func (t *RedisStream) Publish(ctx context.Context, msg *ChangeMessage) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return t.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: t.stream,
+		MaxLen: t.maxLen,
+		Approx: true,
+		Values: []any{streamMessageField, b},
+	}).Err()
+}
+
+// Subscribe implements the Transport interface.
+func (t *RedisStream) Subscribe(ctx context.Context, fn func(*ChangeMessage)) error {
+	lastID := t.LastID()
+	if lastID == "$" {
+		// resolve the current tail, so that no message is missed between two reads.
+		last, err := t.client.XRevRangeN(ctx, t.stream, "+", "-", 1).Result()
+		if err != nil {
+			return err
+		}
+		lastID = "0"
+		if len(last) > 0 {
+			lastID = last[0].ID
+		}
+		t.setLastID(lastID)
+	}
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		res, err := t.client.XRead(ctx, &redis.XReadArgs{
+			Streams: []string{t.stream, t.LastID()},
+			Block:   t.block,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for _, s := range res {
+			for _, xm := range s.Messages {
+				t.setLastID(xm.ID)
+				raw, ok := xm.Values[streamMessageField].(string)
+				if !ok {
+					continue
+				}
+				msg := new(ChangeMessage)
+				if err := json.Unmarshal([]byte(raw), msg); err != nil {
+					logger.Warn("entcache: invalid change message: " + err.Error())
+					continue
+				}
+				fn(msg)
+			}
+		}
+	}
+}
+
+// LastID returns the id of the last consumed message, it can be persisted and passed to WithStreamStartID
+// to resume the subscription.
+func (t *RedisStream) LastID() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastID
+}
+
+func (t *RedisStream) setLastID(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastID = id
+}
+
+// Close implements the Transport interface. The client is owned by the caller and is not closed.
+func (t *RedisStream) Close() error {
+	return nil
+}
@@ -0,0 +1,110 @@
+package entcache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"github.com/tsingsun/woocoo/pkg/log"
+)
+
+type transportSuite struct {
+	suite.Suite
+	Redis  *miniredis.Miniredis
+	client redis.UniversalClient
+}
+
+func TestTransportSuite(t *testing.T) {
+	suite.Run(t, new(transportSuite))
+}
+
+func (t *transportSuite) SetupSuite() {
+	var err error
+	t.Redis, err = miniredis.Run()
+	t.Require().NoError(err)
+	t.client = redis.NewClient(&redis.Options{Addr: t.Redis.Addr()})
+}
+
+func (t *transportSuite) TearDownSuite() {
+	t.client.Close()
+	t.Redis.Close()
+}
+
+func (t *transportSuite) TestPubSub() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	node1 := NewChangeSet(time.Minute, WithTransport(NewRedisPubSub(t.client, "entcache:pubsub")))
+	node2 := NewChangeSet(time.Minute, WithTransport(NewRedisPubSub(t.client, "entcache:pubsub")))
+	go node1.Start(ctx)
+	go node2.Start(ctx)
+	t.Eventually(func() bool {
+		return t.Redis.PubSubNumSub("entcache:pubsub")["entcache:pubsub"] == 2
+	}, time.Second, 10*time.Millisecond)
+
+	node1.Store("User:1")
+	t.Eventually(func() bool {
+		_, ok := node2.Load("User:1")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	node2.Store("User:2")
+	t.Eventually(func() bool {
+		_, ok := node1.Load("User:2")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	_, ok := node2.Load("User:2")
+	t.True(ok)
+}
+
+func (t *transportSuite) TestStream() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := "entcache:stream"
+	node1 := NewChangeSet(time.Minute, WithTransport(NewRedisStream(t.client, stream,
+		WithStreamBlock(50*time.Millisecond))))
+	go node1.Start(ctx)
+	node1.Store("User:1")
+	t.Eventually(func() bool {
+		return t.client.XLen(ctx, stream).Val() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// a late node replays the log.
+	tr := NewRedisStream(t.client, stream, WithStreamStartID("0"), WithStreamBlock(50*time.Millisecond))
+	node2 := NewChangeSet(time.Minute, WithTransport(tr))
+	go node2.Start(ctx)
+	t.Eventually(func() bool {
+		_, ok := node2.Load("User:1")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	node1.Store("User:2")
+	t.Eventually(func() bool {
+		_, ok := node2.Load("User:2")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	t.NotEqual("0", tr.LastID())
+	_, ok := node1.Load("User:2")
+	t.True(ok)
+}
+
+// blockingTransport blocks the publishing until the context is done.
+type blockingTransport struct {
+	Transport
+}
+
+func (blockingTransport) Publish(ctx context.Context, _ *ChangeMessage) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPublishTimeout(t *testing.T) {
+	log.InitGlobalLogger()
+	cs := NewChangeSet(time.Minute, WithTransport(blockingTransport{}), WithPublishTimeout(20*time.Millisecond))
+	start := time.Now()
+	cs.Store("User:1")
+	assert.Less(t, time.Since(start), time.Second)
+	_, ok := cs.Load("User:1")
+	assert.True(t, ok, "marked locally")
+}
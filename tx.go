@@ -0,0 +1,238 @@
+package entcache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"entgo.io/ent/dialect"
+	"entgo.io/ent/dialect/sql"
+)
+
+var _ dialect.Tx = (*Tx)(nil)
+
+// Tx is a transaction of the cached Driver.
+//
+// The changed keys recorded in the transaction, by the statements or by DataChangeNotify, are buffered. They are
+// stored to the ChangeSet only after Commit succeeds, then stored again after TxEvictDelay to evict the entries
+// re-cached by the readers racing with the commit. On Rollback, the buffer is dropped.
+//
+// The tags invalidated by the mutations in the transaction, see WithMutationTags, and the change events, see
+// ChangeSet.Subscribe, are buffered the same way, the events are published once on Commit.
+//
+// The keys recorded after the transaction ended, such as by the hook of a mutation which runs its own
+// transaction, are stored directly if it was committed.
+//
+// The queries in the transaction read the cache too, but a cache miss only queries the database: the rows are not
+// stored, the refs are not updated, and the single flights and the fill locks are not taken, since the rows may be
+// uncommitted or read from an older snapshot, such as under REPEATABLE READ. A read-write transaction keeps the
+// data it mutated as a local overlay, the queries reading them are executed against the database.
+type Tx struct {
+	dialect.Tx
+	drv *Driver
+
+	mu      sync.Mutex
+	changes []Key
+	tags    []string
+	events  []ChangeEvent
+	// dirty holds the keys mutated in the transaction, include the ones recorded by the hook.
+	dirty map[Key]struct{}
+	// done is set when the transaction ended, committed reports whether it was committed.
+	done, committed bool
+}
+
+// Tx starts and returns a read-write transaction which buffers the changed keys until commit.
+func (d *Driver) Tx(ctx context.Context) (dialect.Tx, error) {
+	tx, err := d.Driver.Tx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return d.newTx(tx), nil
+}
+
+// BeginTx starts a transaction with the options, such as the isolation level and read-only. The wrapped
+// driver must support BeginTx.
+func (d *Driver) BeginTx(ctx context.Context, opts *sql.TxOptions) (dialect.Tx, error) {
+	drv, ok := d.Driver.(interface {
+		BeginTx(context.Context, *sql.TxOptions) (dialect.Tx, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("entcache: driver %T does not support BeginTx", d.Driver)
+	}
+	tx, err := drv.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return d.newTx(tx), nil
+}
+
+func (d *Driver) newTx(tx dialect.Tx) *Tx {
+	return &Tx{Tx: tx, drv: d, dirty: make(map[Key]struct{})}
+}
+
+// Exec implements the Execer interface, the changed keys of the statement are buffered.
+func (tx *Tx) Exec(ctx context.Context, query string, args, v any) error {
+	tx.bind(ctx)
+	if err := tx.Tx.Exec(ctx, query, args, v); err != nil {
+		return err
+	}
+	tx.write(ctx, query, args)
+	return nil
+}
+
+// Query implements the Querier interface. A SELECT statement runs through the cache layer, the changed keys
+// of other statements are buffered.
+func (tx *Tx) Query(ctx context.Context, query string, args, v any) error {
+	tx.bind(ctx)
+	if isSelect(query) {
+		return tx.drv.query(ctx, tx.Tx, tx, query, args, v)
+	}
+	if err := tx.Tx.Query(ctx, query, args, v); err != nil {
+		return err
+	}
+	tx.write(ctx, query, args)
+	return nil
+}
+
+// Commit commits the transaction and stores the buffered keys to the ChangeSet.
+func (tx *Tx) Commit() error {
+	if err := tx.Tx.Commit(); err != nil {
+		return err
+	}
+	keys, tags, events := tx.take(true)
+	if len(events) > 0 {
+		tx.drv.publish(events...)
+	}
+	if len(keys) == 0 && len(tags) == 0 {
+		return nil
+	}
+	tx.drv.storeChanges(keys...)
+	tx.drv.invalidateTags(tags)
+	if tx.drv.TxEvictDelay > 0 {
+		time.AfterFunc(tx.drv.TxEvictDelay, func() {
+			tx.drv.storeChanges(keys...)
+			tx.drv.invalidateTags(tags)
+		})
+	}
+	return nil
+}
+
+// Rollback rollbacks the transaction and drops the buffered keys.
+func (tx *Tx) Rollback() error {
+	tx.take(false)
+	return tx.Tx.Rollback()
+}
+
+// bind binds the mutation scope of the context to the transaction, then the keys recorded by the hook are
+// buffered in it.
+func (tx *Tx) bind(ctx context.Context) {
+	if s := mutationFromContext(ctx); s != nil {
+		s.tx = tx
+	}
+}
+
+// write records a data modification statement. The statements left to the hook are only added to the
+// overlay, so that the mutation reads its own writes before the hook runs.
+func (tx *Tx) write(ctx context.Context, query string, args any) {
+	keys, _ := statementChanges(query, args)
+	tx.mu.Lock()
+	for _, key := range keys {
+		tx.dirty[key] = struct{}{}
+	}
+	tx.mu.Unlock()
+	keys, event := tx.drv.writeChanges(ctx, query, args)
+	tx.store(keys...)
+	if event != nil {
+		tx.storeEvents(*event)
+	}
+}
+
+func (tx *Tx) store(keys ...Key) {
+	if len(keys) == 0 {
+		return
+	}
+	tx.mu.Lock()
+	if !tx.done {
+		tx.changes = append(tx.changes, keys...)
+		for _, key := range keys {
+			tx.dirty[key] = struct{}{}
+		}
+		tx.mu.Unlock()
+		return
+	}
+	committed := tx.committed
+	tx.mu.Unlock()
+	if committed {
+		tx.drv.storeChanges(keys...)
+	}
+}
+
+// storeTags buffers the tags invalidated by a mutation, like store.
+func (tx *Tx) storeTags(tags ...string) {
+	if len(tags) == 0 {
+		return
+	}
+	tx.mu.Lock()
+	if !tx.done {
+		tx.tags = append(tx.tags, tags...)
+		tx.mu.Unlock()
+		return
+	}
+	committed := tx.committed
+	tx.mu.Unlock()
+	if committed {
+		tx.drv.invalidateTags(tags)
+	}
+}
+
+// storeEvents buffers the change events, like store.
+func (tx *Tx) storeEvents(events ...ChangeEvent) {
+	if len(events) == 0 {
+		return
+	}
+	tx.mu.Lock()
+	if !tx.done {
+		tx.events = append(tx.events, events...)
+		tx.mu.Unlock()
+		return
+	}
+	committed := tx.committed
+	tx.mu.Unlock()
+	if committed {
+		tx.drv.publish(events...)
+	}
+}
+
+// overlaps reports whether the query with the entry key reads the data mutated in the transaction.
+func (tx *Tx) overlaps(key Key, query string) bool {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if len(tx.dirty) == 0 {
+		return false
+	}
+	if key != "" {
+		if _, ok := tx.dirty[key]; ok {
+			return true
+		}
+		if _, ok := tx.dirty[NewTypeKey(entryType(key))]; ok {
+			return true
+		}
+	}
+	for _, table := range queryTables(query) {
+		if _, ok := tx.dirty[NewTableKey(table)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// take ends the transaction and returns the buffered keys, tags and events.
+func (tx *Tx) take(committed bool) ([]Key, []string, []ChangeEvent) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	keys, tags, events := tx.changes, tx.tags, tx.events
+	tx.changes, tx.tags, tx.events = nil, nil, nil
+	tx.done, tx.committed = true, committed
+	return keys, tags, events
+}